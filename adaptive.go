@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 自适应并发, 按 AIMD 的方式调整同时扫描的IP数
+// 没有问题时每次加一点, 超时率突然升高或者出现本地资源错误 (文件数、缓冲区不够) 时减少
+// 只统计超时, 连接被拒绝、握手失败、验证不通过等是IP本身不符合, 不代表网络堵塞
+// 最大值不超过 MaxScanWorker 和 ulimit -n 允许的数量
+
+const (
+	// 多久调整一次
+	adaptiveInterval = 2 * time.Second
+	// 一次调整至少需要的结果数, 太少的话超时率不准确
+	adaptiveMinSamples = 20
+	// 超时率比基准高出这么多时认为网络堵塞了
+	adaptiveFailureRise = 0.1
+	// 每个扫描大概使用的文件数, 有些扫描方式会同时打开多个连接
+	fdsPerWorker = 2
+	// 留给程序其他部分的文件数
+	fdsReserved = 64
+)
+
+// resourceErrors 是出现本地资源错误的次数, netTimeouts 是连接超时的次数, 各扫描方式通过 noteNetError 记录
+var (
+	resourceErrors int32
+	netTimeouts    int32
+)
+
+// noteNetError 在 err 是本地资源不够或者超时的错误时记录下来, 返回 err 本身
+func noteNetError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ENOBUFS):
+		atomic.AddInt32(&resourceErrors, 1)
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()):
+		atomic.AddInt32(&netTimeouts, 1)
+	}
+	return err
+}
+
+// dialContext 和 net.Dialer.DialContext 一样, 会记录本地资源错误
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	return conn, noteNetError(err)
+}
+
+type workerController struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+	min    int
+	max    int
+	step   int
+
+	// 当前窗口扫描完的IP数
+	done int
+	// 没有减少时的超时率, 用来判断是否变高了, 小于 0 表示还没有
+	baseline float64
+}
+
+// newWorkerController 初始并发为 start, 最大为 maxWorkers, 会按 ulimit -n 减少
+// fixed 是不受控制的线程数, 比如 Pipeline 各阶段的线程, 先从 ulimit -n 中减去它们使用的文件数
+func newWorkerController(start, maxWorkers, fixed int) *workerController {
+	if limit := openFilesLimit(); limit > 0 {
+		maxWorkers = min(maxWorkers, (limit-fdsReserved)/fdsPerWorker-fixed)
+	}
+	maxWorkers = max(maxWorkers, 1)
+	start = min(max(start, 1), maxWorkers)
+	c := &workerController{
+		limit:    start,
+		min:      1,
+		max:      maxWorkers,
+		step:     max(start/10, 1),
+		baseline: -1,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	log.Printf("Adaptive workers: start %d, max %d, open files limit %d\n", start, maxWorkers, openFilesLimit())
+	return c
+}
+
+// run 定时调整并发数, ctx 结束时返回
+func (c *workerController) run(ctx context.Context) {
+	t := time.NewTicker(adaptiveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// 唤醒等待的线程, 让它们退出
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			return
+		case <-t.C:
+			c.adjust()
+		}
+	}
+}
+
+func (c *workerController) adjust() {
+	resErrs := atomic.SwapInt32(&resourceErrors, 0)
+	timeouts := atomic.SwapInt32(&netTimeouts, 0)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.limit
+	var ratio float64
+	if c.done > 0 {
+		// 多端口或者前面的阶段会让一个IP超时多次
+		ratio = min(float64(timeouts)/float64(c.done), 1)
+	}
+	switch {
+	case resErrs > 0:
+		c.limit = max(c.limit/2, c.min)
+	case c.done < adaptiveMinSamples:
+		return
+	case c.baseline >= 0 && ratio > c.baseline+adaptiveFailureRise:
+		c.limit = max(c.limit/2, c.min)
+		// 超时率可能是因为IP段变了, 基准也要跟着变, 不然会一直减少
+		c.baseline = (c.baseline + ratio) / 2
+	default:
+		if c.baseline < 0 {
+			c.baseline = ratio
+		} else {
+			c.baseline = c.baseline*0.8 + ratio*0.2
+		}
+		c.limit = min(c.limit+c.step, c.max)
+	}
+	c.done = 0
+
+	if c.limit != old {
+		log.Printf("Adaptive workers: %d -> %d, timeout %.0f%%, resource errors %d\n", old, c.limit, ratio*100, resErrs)
+		c.cond.Broadcast()
+	}
+}
+
+// acquire 等待一个扫描名额, ctx 结束时返回 false, c 为 nil 时不限制
+func (c *workerController) acquire(ctx context.Context) bool {
+	if c == nil {
+		return ctx.Err() == nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.active >= c.limit && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	c.active++
+	return true
+}
+
+// release 归还名额, scanned 表示扫描完了一个IP, 跳过或者中断的不算
+func (c *workerController) release(scanned bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.active--
+	if scanned {
+		c.done++
+	}
+	c.mu.Unlock()
+	c.cond.Signal()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// checkpoint 保存扫描的进度, 使用 -resume 启动时从这里继续
+// 已经扫描过的IP不会再扫描, 已经发出但还没扫描完的会重新扫描
+type checkpoint struct {
+	// 打乱IP段顺序使用的随机数种子, 所有扫描方式共用
+	Seed int64
+	// 每个扫描方式的进度, 和 ScanMode 的顺序相同
+	Profiles []*profileCheckpoint
+}
+
+type profileCheckpoint struct {
+	ScanMode string
+	// IP段文件和影响扫描顺序的设置的 hash, 不同时不能继续
+	InputHash string
+	// 还没有遍历完的IP段和下一个要取的位置
+	Order []int
+	Pos   int
+	// 每个IP段的遍历位置
+	Cursors   []ipCursor
+	Pending   []string
+	ScanCount int32
+	Records   []*ScanRecord
+}
+
+type ipCursor struct {
+	K    [2]uint64
+	J    [2]uint64
+	Done bool
+}
+
+var errCheckpointMismatch = errors.New("checkpoint does not match the current IP range file or config")
+
+// snapshot 保存当前的扫描位置
+func (f *ipFeeder) snapshot(cp *profileCheckpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cp.InputHash = f.hash
+	cp.Order = append([]int(nil), f.order...)
+	cp.Pos = f.pos
+	cp.Cursors = make([]ipCursor, len(f.iters))
+	for i, it := range f.iters {
+		cp.Cursors[i] = ipCursor{
+			K:    [2]uint64{it.k.hi, it.k.lo},
+			J:    [2]uint64{it.j.hi, it.j.lo},
+			Done: it.done,
+		}
+	}
+	cp.Pending = make([]string, 0, len(f.pending))
+	for addr := range f.pending {
+		cp.Pending = append(cp.Pending, addr)
+	}
+	sort.Strings(cp.Pending)
+}
+
+// restore 从 checkpoint 恢复扫描位置, 需要使用相同的 seed 创建
+func (f *ipFeeder) restore(cp *profileCheckpoint) error {
+	if cp.InputHash != f.hash || len(cp.Cursors) != len(f.iters) {
+		return errCheckpointMismatch
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, i := range cp.Order {
+		if i < 0 || i >= len(f.iters) {
+			return errCheckpointMismatch
+		}
+	}
+	f.order = cp.Order
+	f.pos = cp.Pos
+	for i, c := range cp.Cursors {
+		it := f.iters[i]
+		it.k = uint128{c.K[0], c.K[1]}
+		it.j = uint128{c.J[0], c.J[1]}
+		it.done = c.Done
+	}
+	f.resumed = cp.Pending
+	for _, addr := range cp.Pending {
+		f.pending[addr]++
+	}
+	return nil
+}
+
+func loadCheckpoint(file string) (*checkpoint, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cp := new(checkpoint)
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", file, err)
+	}
+	return cp, nil
+}
+
+// saveCheckpoint 保存扫描进度, 先写到临时文件再改名, 避免写到一半时中断
+func (gs *GScanner) saveCheckpoint() {
+	if len(gs.profiles) == 0 || gs.CheckpointFile == "" {
+		return
+	}
+	cp := &checkpoint{Seed: gs.profiles[0].feeder.seed}
+	for _, p := range gs.profiles {
+		// 持有 progress 锁, 不会出现记录已经标记扫描完但还没有保存到 Records 的情况
+		p.progress.Lock()
+		pc := &profileCheckpoint{
+			ScanMode:  p.mode,
+			ScanCount: p.ScanCount(),
+			Records:   p.Records(),
+		}
+		p.feeder.snapshot(pc)
+		p.progress.Unlock()
+		cp.Profiles = append(cp.Profiles, pc)
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		log.Printf("Failed to save checkpoint: %v\n", err)
+		return
+	}
+	tmp := gs.CheckpointFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("Failed to save checkpoint: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmp, gs.CheckpointFile); err != nil {
+		log.Printf("Failed to save checkpoint: %v\n", err)
+	}
+}
+
+// resume 恢复之前扫描到的记录和计数, 扫描方式需要和之前的一样
+func (gs *GScanner) resume(cp *checkpoint) error {
+	if len(cp.Profiles) != len(gs.profiles) {
+		return fmt.Errorf("checkpoint is for scan mode %s, not %s", checkpointModes(cp), gs.ScanMode)
+	}
+	for i, p := range gs.profiles {
+		pc := cp.Profiles[i]
+		if pc.ScanMode != p.mode {
+			return fmt.Errorf("checkpoint is for scan mode %s, not %s", checkpointModes(cp), gs.ScanMode)
+		}
+		if err := p.feeder.restore(pc); err != nil {
+			return err
+		}
+		p.recordMutex.Lock()
+		p.records = pc.Records
+		p.recordMutex.Unlock()
+		p.scanCounter = pc.ScanCount
+		// 之前已经达到 RecordLimit 的不再扫描
+		p.stopped.Store(len(pc.Records) >= p.config.RecordLimit)
+		log.Printf("%sResumed from checkpoint: scanned %d IPs, found %d records, %d pending\n",
+			p.logPrefix(), pc.ScanCount, len(pc.Records), len(pc.Pending))
+	}
+	return nil
+}
+
+func checkpointModes(cp *checkpoint) scanModes {
+	modes := make(scanModes, len(cp.Profiles))
+	for i, pc := range cp.Profiles {
+		modes[i] = pc.ScanMode
+	}
+	return modes
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func newTestFeeder(t *testing.T, file string, ports []int) *ipFeeder {
+	t.Helper()
+	f, err := newIPFeeder(file, ports, 24, 48, 42, shard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func drainFeeder(f *ipFeeder) []string {
+	var addrs []string
+	for addr := range f.start() {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "iprange.txt")
+	data := "10.0.0.0/23\n10.1.0.0/30:8443\n2001:db8::/126\n10.2.0.1\n"
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ports := []int{443, 2053}
+	all := drainFeeder(newTestFeeder(t, file, ports))
+
+	// 取一部分地址, 其中一些扫描完, 剩下的中断时还在扫描
+	f := newTestFeeder(t, file, ports)
+	var scanned, pending []string
+	for i := 0; i < 100; i++ {
+		for _, addr := range f.next() {
+			if i%3 == 0 {
+				pending = append(pending, addr)
+			} else {
+				scanned = append(scanned, addr)
+				f.done(addr)
+			}
+		}
+	}
+
+	cp := new(profileCheckpoint)
+	f.snapshot(cp)
+	b, err := json.Marshal(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp = new(profileCheckpoint)
+	if err := json.Unmarshal(b, cp); err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Pending) != len(pending) {
+		t.Fatalf("got %d pending addresses, want %d", len(cp.Pending), len(pending))
+	}
+
+	g := newTestFeeder(t, file, ports)
+	if err := g.restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	rest := drainFeeder(g)
+
+	// 继续扫描的是没有扫描完的, 和之前扫描完的合起来正好是所有地址
+	seen := make(map[string]int, len(all))
+	for _, addr := range append(scanned, rest...) {
+		seen[addr]++
+	}
+	for _, addr := range all {
+		if seen[addr] != 1 {
+			t.Errorf("address %s scanned %d times", addr, seen[addr])
+		}
+	}
+	if len(seen) != len(all) {
+		t.Errorf("got %d addresses, want %d", len(seen), len(all))
+	}
+	// 没有扫描完的最先扫描, 按地址排序
+	sort.Strings(pending)
+	for i, addr := range pending {
+		if rest[i] != addr {
+			t.Errorf("pending address %d is %s, want %s", i, rest[i], addr)
+		}
+	}
+}
+
+func TestCheckpointMismatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "iprange.txt")
+	if err := os.WriteFile(file, []byte("10.0.0.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cp := new(profileCheckpoint)
+	newTestFeeder(t, file, nil).snapshot(cp)
+
+	// 端口不同时扫描顺序不同, 不能继续
+	if err := newTestFeeder(t, file, []int{443}).restore(cp); err != errCheckpointMismatch {
+		t.Errorf("restore with different ports: got %v, want %v", err, errCheckpointMismatch)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 普通的 DNS 查询, 端口为 53
+
+func testDns(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	q := config.dns.question
+
+	network := config.DNSNetwork
+
+	// lv1 返回格式正确的 DNS 响应
+	m, err := dnsExchange(ctx, network, ip, q, config.HandshakeTimeout)
+	if err != nil {
+		return false
+	}
+	// 响应被截断时改用 TCP 重新查询
+	if m.Truncated && network == "udp" {
+		if m, err = dnsExchange(ctx, "tcp", ip, q, config.HandshakeTimeout); err != nil {
+			return false
+		}
+	}
+	record.SetInfo("resolve", time.Since(start).Round(time.Millisecond).String())
+
+	if !verifyDNSResponse(m, q, config, record) {
+		return false
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+func dnsExchange(ctx context.Context, network, ip string, q dnsmessage.Question, timeout time.Duration) (*dnsmessage.Message, error) {
+	conn, err := dialContext(ctx, network, hostPort(ip, "53"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	id := uint16(rand.Intn(0x10000))
+	query, err := packDNSQuery(id, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		resp, err := dnsExchangeStream(conn, query)
+		if err != nil {
+			return nil, err
+		}
+		return parseDNSResponse(resp, id, q)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 65535)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略不对应的响应, 继续等待直到超时
+		if m, err := parseDNSResponse(resp[:n], id, q); err == nil {
+			return m, nil
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS 相关模式共用的查询和验证
+
+var (
+	errDNSType     = errors.New("dns: unsupported query type")
+	errDNSMismatch = errors.New("dns: response does not match query")
+	errDNSRcode    = errors.New("dns: bad rcode")
+)
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"NS":    dnsmessage.TypeNS,
+	"CNAME": dnsmessage.TypeCNAME,
+	"SOA":   dnsmessage.TypeSOA,
+	"PTR":   dnsmessage.TypePTR,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"SRV":   dnsmessage.TypeSRV,
+}
+
+// dnsParams 是载入配置时解析好的 DNS 相关设置
+type dnsParams struct {
+	question dnsmessage.Question
+}
+
+// parseDNSParams 检查 DNS 相关的设置并生成查询的问题, 设置错误时在载入配置时就报错
+func (sc *ScanConfig) parseDNSParams() error {
+	q, err := dnsQuestion(sc)
+	if err != nil {
+		return fmt.Errorf("%v: %s %s", err, sc.DNSName, sc.DNSType)
+	}
+	sc.dns.question = q
+
+	sc.DoHProtocol = strings.ToLower(or(sc.DoHProtocol, "h2"))
+	if sc.DoHProtocol != "h2" && sc.DoHProtocol != "h3" {
+		return fmt.Errorf("unknown DoHProtocol: %s, should be h2 or h3", sc.DoHProtocol)
+	}
+	sc.DNSNetwork = strings.ToLower(or(sc.DNSNetwork, "udp"))
+	if sc.DNSNetwork != "udp" && sc.DNSNetwork != "tcp" {
+		return fmt.Errorf("unknown DNSNetwork: %s, should be udp or tcp", sc.DNSNetwork)
+	}
+	return nil
+}
+
+// dnsQuestion 根据 DNSName 和 DNSType 生成查询的问题
+func dnsQuestion(config *ScanConfig) (dnsmessage.Question, error) {
+	typ, ok := dnsTypes[strings.ToUpper(or(config.DNSType, "A"))]
+	if !ok {
+		return dnsmessage.Question{}, errDNSType
+	}
+	name := or(config.DNSName, "www.google.com")
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return dnsmessage.Question{}, err
+	}
+	return dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET}, nil
+}
+
+func packDNSQuery(id uint16, q dnsmessage.Question) ([]byte, error) {
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	return m.Pack()
+}
+
+// parseDNSResponse 解析响应, 并检查是否和查询对应, 不检查 RCODE
+func parseDNSResponse(b []byte, id uint16, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	m := new(dnsmessage.Message)
+	if err := m.Unpack(b); err != nil {
+		return nil, err
+	}
+	if !m.Response || m.ID != id || len(m.Questions) != 1 {
+		return nil, errDNSMismatch
+	}
+	rq := m.Questions[0]
+	if rq.Type != q.Type || rq.Class != q.Class || !strings.EqualFold(rq.Name.String(), q.Name.String()) {
+		return nil, errDNSMismatch
+	}
+	return m, nil
+}
+
+// dnsAnswers 返回和问题类型相同的记录的值
+func dnsAnswers(m *dnsmessage.Message, typ dnsmessage.Type) []string {
+	var a []string
+	for _, r := range m.Answers {
+		if r.Header.Type != typ {
+			continue
+		}
+		switch b := r.Body.(type) {
+		case *dnsmessage.AResource:
+			a = append(a, net.IP(b.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			a = append(a, net.IP(b.AAAA[:]).String())
+		case *dnsmessage.CNAMEResource:
+			a = append(a, b.CNAME.String())
+		case *dnsmessage.NSResource:
+			a = append(a, b.NS.String())
+		case *dnsmessage.PTRResource:
+			a = append(a, b.PTR.String())
+		case *dnsmessage.MXResource:
+			a = append(a, b.MX.String())
+		case *dnsmessage.SRVResource:
+			a = append(a, b.Target.String())
+		case *dnsmessage.SOAResource:
+			a = append(a, b.NS.String())
+		case *dnsmessage.TXTResource:
+			a = append(a, strings.Join(b.TXT, ""))
+		}
+	}
+	return a
+}
+
+// matchDNSExpect 返回是否有记录符合 DNSExpect
+// DNSExpect 为空时, 只要有记录就算符合, A/AAAA 记录可以使用 CIDR 格式
+func matchDNSExpect(answers, expect []string) bool {
+	if len(expect) == 0 {
+		return len(answers) > 0
+	}
+	for _, a := range answers {
+		ip := net.ParseIP(a)
+		for _, e := range expect {
+			if strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(e, ".")) {
+				return true
+			}
+			if _, ipnet, err := net.ParseCIDR(e); err == nil && ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyDNSResponse 按照 Level 检查 dns 和 dot 模式的响应, 并记录附加信息
+func verifyDNSResponse(m *dnsmessage.Message, q dnsmessage.Question, config *ScanConfig, record *ScanRecord) bool {
+	answers := dnsAnswers(m, q.Type)
+	matched := m.RCode == dnsmessage.RCodeSuccess && matchDNSExpect(answers, config.DNSExpect)
+
+	record.SetInfo("rcode", strings.ToLower(strings.TrimPrefix(m.RCode.String(), "RCode")))
+	record.SetInfo("ra", strconv.FormatBool(m.RecursionAvailable))
+	record.SetInfo("match", strconv.FormatBool(matched))
+
+	// lv2 提供递归查询, 并且查询成功
+	if config.Level > 1 && (!m.RecursionAvailable || m.RCode != dnsmessage.RCodeSuccess) {
+		return false
+	}
+	// lv3 记录符合 DNSExpect
+	if config.Level > 2 && !matched {
+		return false
+	}
+	if len(answers) > 0 {
+		record.SetInfo("answer", strings.Join(answers, ","))
+	}
+	return true
+}
+
+// dnsExchangeStream 通过 TCP 或 TLS 连接查询, 消息前面带有两字节的长度
+func dnsExchangeStream(rw io.ReadWriter, query []byte) ([]byte, error) {
+	b := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(b, uint16(len(query)))
+	copy(b[2:], query)
+	if _, err := rw.Write(b); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(rw, b[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(b[:2]))
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
+)
+
+// DNS-over-HTTPS, 参考 RFC 8484
+
+const dohContentType = "application/dns-message"
+
+var errDoHResponse = errors.New("doh: bad response")
+
+func testDoH(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	q := config.dns.question
+	host := config.verifyHost()
+	if host == "" {
+		return false
+	}
+	serverName := host
+	if len(config.ServerName) > 0 {
+		serverName = randomChoice(config.ServerName)
+	}
+	addr := hostPort(ip, "443")
+
+	// 不论请求的是哪个域名, 都连接到要测试的IP
+	var tr http.RoundTripper
+	proto := config.DoHProtocol
+	switch proto {
+	case "h2":
+		h2tr := &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, _ string, cfg *tls.Config) (net.Conn, error) {
+				cfg = cfg.Clone()
+				cfg.InsecureSkipVerify = true
+				cfg.ServerName = serverName
+				dialer := &tls.Dialer{Config: cfg}
+				conn, err := dialer.DialContext(ctx, network, addr)
+				return conn, noteNetError(err)
+			},
+		}
+		defer h2tr.CloseIdleConnections()
+		tr = h2tr
+	case "h3":
+		h3tr := &http3.RoundTripper{
+			QuicConfig: &quic.Config{HandshakeIdleTimeout: config.HandshakeTimeout},
+			Dial: func(ctx context.Context, _ string, cfg *tls.Config, qcfg *quic.Config) (quic.EarlyConnection, error) {
+				cfg = cfg.Clone()
+				cfg.InsecureSkipVerify = true
+				cfg.ServerName = serverName
+				conn, err := quic.DialAddrEarly(ctx, addr, cfg, qcfg)
+				return conn, noteNetError(err)
+			},
+		}
+		defer h3tr.Close()
+		tr = h3tr
+	}
+
+	hclient := &http.Client{
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	url := "https://" + host + or(config.DoHPath, "/dns-query")
+
+	// lv1 GET 请求返回格式正确的 DNS 响应
+	m, err := dohQuery(ctx, hclient, http.MethodGet, url, q)
+	if err != nil {
+		return false
+	}
+	record.SetInfo("doh", proto)
+
+	// lv2 记录符合 DNSExpect
+	if config.Level > 1 {
+		answers := dnsAnswers(m, q.Type)
+		if !matchDNSExpect(answers, config.DNSExpect) {
+			return false
+		}
+		record.SetInfo("answer", strings.Join(answers, ","))
+	}
+
+	// lv3 POST 请求也要成功
+	if config.Level > 2 {
+		m, err := dohQuery(ctx, hclient, http.MethodPost, url, q)
+		if err != nil || !matchDNSExpect(dnsAnswers(m, q.Type), config.DNSExpect) {
+			return false
+		}
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+// dohQuery 使用 GET 或 POST 发送查询, RFC 8484 建议 ID 设置为 0
+func dohQuery(ctx context.Context, hclient *http.Client, method, url string, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	b, err := packDNSQuery(0, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if method == http.MethodGet {
+		req, err = http.NewRequestWithContext(ctx, method, url+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewReader(b))
+		if req != nil {
+			req.Header.Set("Content-Type", dohContentType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := hclient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), dohContentType) {
+		io.Copy(io.Discard, resp.Body)
+		return nil, errDoHResponse
+	}
+	// DNS 消息最大 64KB
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseDNSResponse(body, 0, q)
+	if err != nil {
+		return nil, err
+	}
+	if m.RCode != dnsmessage.RCodeSuccess {
+		return nil, errDNSRcode
+	}
+	return m, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"time"
+)
+
+// DNS-over-TLS, 参考 RFC 7858, 端口为 853
+
+func testDoT(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	q := config.dns.question
+
+	conn, err := dialContext(ctx, "tcp", hostPort(ip, "853"))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	// 默认不发送 SNI
+	var serverName string
+	if len(config.ServerName) > 0 {
+		serverName = randomChoice(config.ServerName)
+	}
+	tlsconn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+		NextProtos:         []string{"dot"},
+	})
+	defer tlsconn.Close()
+
+	tlsconn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+	if err = tlsconn.Handshake(); err != nil {
+		return false
+	}
+
+	// lv1 返回格式正确的 DNS 响应
+	resolveStart := time.Now()
+	tlsconn.SetDeadline(start.Add(config.ScanMaxRTT))
+	id := uint16(rand.Intn(0x10000))
+	query, err := packDNSQuery(id, q)
+	if err != nil {
+		return false
+	}
+	resp, err := dnsExchangeStream(tlsconn, query)
+	if err != nil {
+		return false
+	}
+	m, err := parseDNSResponse(resp, id, q)
+	if err != nil {
+		return false
+	}
+	record.SetInfo("resolve", time.Since(resolveStart).Round(time.Millisecond).String())
+
+	if !verifyDNSResponse(m, q, config, record) {
+		return false
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
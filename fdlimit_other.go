@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// openFilesLimit 在没有 ulimit 的系统上返回 0, 表示不限制
+func openFilesLimit() int {
+	return 0
+}
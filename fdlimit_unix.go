@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// openFilesLimit 返回 ulimit -n 的值
+func openFilesLimit() int {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0
+	}
+	// 无限制时是一个很大的数
+	return int(min(rlim.Cur, 1<<20))
+}
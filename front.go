@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// 域前置验证, tls/quic 的 ServerName 使用 ServerName, http 的 Host 使用 FrontHosts
+// 每个等级都会使用 FrontHosts 访问, 只有响应符合 ExpectStatus、ExpectHeaders、ExpectBody,
+// 才能证明确实是前置的域名返回的, 所以 ExpectHeaders 和 ExpectBody 至少要设置一个
+
+func testFront(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	var serverName string
+	if len(config.ServerName) == 0 {
+		serverName = randomHost()
+	} else {
+		serverName = randomChoice(config.ServerName)
+	}
+	frontHost := randomChoice(config.FrontHosts)
+	url := "https://" + frontHost + or(config.HTTPPath, "/")
+
+	var (
+		cs      tls.ConnectionState
+		doHTTP  func() (*http.Response, error)
+		cleanup func()
+	)
+	switch strings.ToLower(or(config.FrontProtocol, "tls")) {
+	case "tls":
+		conn, err := dialContext(ctx, "tcp", hostPort(ip, "443"))
+		if err != nil {
+			return false
+		}
+		tlsconn := tls.Client(conn, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         serverName,
+			NextProtos:         []string{"http/1.1"},
+		})
+		cleanup = func() { tlsconn.Close() }
+
+		tlsconn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+		if err := tlsconn.Handshake(); err != nil {
+			cleanup()
+			return false
+		}
+		cs = tlsconn.ConnectionState()
+		doHTTP = func() (*http.Response, error) {
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Close = true
+			tlsconn.SetDeadline(start.Add(config.ScanMaxRTT))
+			if err := req.Write(tlsconn); err != nil {
+				return nil, err
+			}
+			return http.ReadResponse(bufio.NewReader(tlsconn), req)
+		}
+	case "quic":
+		quicConn, err := quic.DialAddrEarly(ctx, hostPort(ip, "443"), &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         serverName,
+			NextProtos:         []string{"h3"},
+		}, &quic.Config{HandshakeIdleTimeout: config.HandshakeTimeout})
+		if noteNetError(err) != nil {
+			return false
+		}
+		tr := &http3.RoundTripper{
+			DisableCompression: true,
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+				return quicConn, nil
+			},
+		}
+		cleanup = func() {
+			tr.Close()
+			quicConn.CloseWithError(0, "")
+		}
+
+		cs = quicConn.ConnectionState().TLS
+		if !cs.HandshakeComplete {
+			cleanup()
+			return false
+		}
+		doHTTP = func() (*http.Response, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return nil, err
+			}
+			return tr.RoundTrip(req)
+		}
+	default:
+		return false
+	}
+	defer cleanup()
+
+	record.SetInfo("sni", serverName)
+
+	// lv2 验证服务商的证书
+	if config.Level > 1 && !config.provider.verifyCert(cs.PeerCertificates) {
+		return false
+	}
+
+	// lv1 使用 ServerName 握手, 再使用 FrontHosts 访问, 验证响应确实来自前置的域名
+	resp, err := doHTTP()
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if !config.matchStatus(resp.StatusCode) || !config.matchHeaders(resp.Header) {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil || !config.matchBody(body) {
+		return false
+	}
+	record.SetInfo("front", frontHost)
+	record.SetInfo("status", strconv.Itoa(resp.StatusCode))
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+// checkFront 检查域前置的设置, 没有 FrontHosts 或者无法证明响应来自前置的域名时返回错误
+func (sc *ScanConfig) checkFront() error {
+	if len(sc.FrontHosts) == 0 {
+		return errors.New("front: FrontHosts is empty")
+	}
+	if len(sc.ExpectHeaders) == 0 && sc.ExpectBody == "" {
+		return errors.New("front: ExpectHeaders or ExpectBody must be set to prove the response is from FrontHosts")
+	}
+	return nil
+}
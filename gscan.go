@@ -1,17 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strings"
 	"time"
 )
@@ -27,25 +28,121 @@ type ScanConfig struct {
 	InputFile        string
 	OutputFile       string
 	OutputSeparator  string
+	OutputFilter     []string
 	Level            int
+	Ports            []int
+
+	// ScanCountPerIP 大于 1 时使用, 允许的失败比例和延迟的标准差
+	MaxLoss   float64
+	MaxJitter time.Duration
+	// 输出结果的排序方式, 可以是 rtt、min、median、max、stddev、loss
+	SortBy string
+
+	// 所有扫描线程共用的限速, 每秒的新连接数和测试次数, 0 表示不限制
+	ConnRate  int
+	ProbeRate int
+	RateBurst int
+	limiter   *rateLimiter
+
+	// TCP 和 SYN 模式测试的端口
+	TCPPorts []int
+
+	// DNS 相关模式使用
+	DNSName     string
+	DNSType     string
+	DNSExpect   []string
+	DoHPath     string
+	DoHProtocol string
+	DNSNetwork  string
+	dns         dnsParams
+
+	// 代理扫描使用
+	ProxyTarget   string
+	ProxyUsername string
+	ProxyPassword string
+
+	// TLS 和 SNI 模式使用
+	MinVersion       string
+	MaxVersion       string
+	CipherSuites     []string
+	CurvePreferences []string
+	NextProtos       []string
+	// SNI 模式验证证书链使用的根证书, PEM 格式, 不设置时使用系统的
+	CAFile string
+	tls    tlsParams
+
+	// HTTP 和域前置模式使用
+	HTTPPath      string
+	ExpectStatus  []int
+	ExpectHeaders map[string]string
+	ExpectBody    string
+
+	// 域前置模式使用
+	FrontHosts    []string
+	FrontProtocol string
+
+	// 跳数测试使用
+	MaxHops       int
+	TraceLastHops int
+	TraceProtocol string
+
+	// QUIC、TLS 等模式验证的服务商, 默认为 google
+	Provider string
+	provider *ProviderProfile
 }
 
 type GScanner struct {
 	ScanWorker     int
+	AdaptiveWorker bool
+	MaxScanWorker  int
+	MaxPerSubnet   int
+	SubnetPrefixV4 int
+	SubnetPrefixV6 int
 	VerifyPing     bool
 	ScanMinPingRTT time.Duration
 	ScanMaxPingRTT time.Duration
-	DisablePause   bool
-	EnableBackup   bool
-	BackupDir      string
+	VerifySYN      bool
+	VerifyTCP      bool
+	VerifyQuicVN   bool
+	TraceAfterScan bool
+	// 扫描前的测试阶段, 按顺序进行, 在 Verify* 之后
+	Pipeline     []PipelineStage
+	DisablePause bool
+	EnableBackup bool
+	BackupDir    string
+
+	// 自定义的服务商, 同名的会覆盖内置的
+	Providers map[string]*ProviderProfile
 
-	ScanRecords `json:"-"`
+	// 每隔多久保存一次扫描进度, 单位: 秒, 0 表示不保存
+	CheckpointInterval time.Duration
+	CheckpointFile     string
 
-	ScanMode string
-	PING     ScanConfig
-	QUIC     ScanConfig
-	TLS      ScanConfig
-	SNI      ScanConfig
+	workers  *workerController
+	subnets  *subnetLimiter
+	stages   []*scanStage
+	profiles []*scanProfile
+	shard    shard
+
+	// 可以是一个扫描方式或者列表, 列表中的扫描方式会同时扫描
+	ScanMode  scanModes
+	PING      ScanConfig
+	QUIC      ScanConfig
+	TLS       ScanConfig
+	SNI       ScanConfig
+	SOCKS5    ScanConfig
+	SOCKS4    ScanConfig
+	HTTPProxy ScanConfig
+	H2        ScanConfig
+	TCP       ScanConfig
+	SYN       ScanConfig
+	DoH       ScanConfig
+	DoT       ScanConfig
+	DNS       ScanConfig
+	QUICVN    ScanConfig
+	HTTP      ScanConfig
+	Front     ScanConfig
+	Trace     ScanConfig
 }
 
 func init() {
@@ -80,15 +177,68 @@ func (gs *GScanner) loadConfig(cfgFile string) error {
 		}
 	}
 
-	config.ScanMode = strings.ToLower(config.ScanMode)
-	if config.ScanMode == "ping" {
+	if len(config.ScanMode) == 0 {
+		return errors.New("no scan mode")
+	}
+	seen := make(map[string]bool)
+	for i, mode := range config.ScanMode {
+		mode = strings.ToLower(mode)
+		if _, _, ok := config.lookupScanConfig(mode); !ok {
+			return fmt.Errorf("unknown scan mode: %s", mode)
+		}
+		// 同一个扫描方式的输出文件是一样的, 不能重复
+		if seen[mode] {
+			return fmt.Errorf("duplicate scan mode: %s", mode)
+		}
+		seen[mode] = true
+		config.ScanMode[i] = mode
+	}
+	if config.ScanMode.only("ping") {
 		config.VerifyPing = false
 	}
+	if config.ScanMode.only("syn") {
+		config.VerifySYN = false
+	}
+	if config.ScanMode.only("tcp") {
+		config.VerifyTCP = false
+	}
+	if config.ScanMode.only("quicvn") {
+		config.VerifyQuicVN = false
+	}
+
+	config.SubnetPrefixV4 = or(config.SubnetPrefixV4, 24)
+	config.SubnetPrefixV6 = or(config.SubnetPrefixV6, 48)
+	if config.SubnetPrefixV4 > 32 || config.SubnetPrefixV6 > 128 {
+		return fmt.Errorf("invalid subnet prefix: /%d, /%d", config.SubnetPrefixV4, config.SubnetPrefixV6)
+	}
+
+	config.CheckpointInterval *= time.Second
+	config.CheckpointFile = or(config.CheckpointFile, "./checkpoint.json")
+	if strings.HasPrefix(config.CheckpointFile, "./") {
+		config.CheckpointFile = filepath.Join(execFolder, config.CheckpointFile)
+	}
 
 	config.ScanMinPingRTT *= time.Millisecond
 	config.ScanMaxPingRTT *= time.Millisecond
 
-	scanConfigs := []*ScanConfig{&config.QUIC, &config.TLS, &config.SNI, &config.PING}
+	customProviders := make(map[string]*ProviderProfile)
+	for name, p := range config.Providers {
+		customProviders[strings.ToLower(name)] = p
+	}
+	config.Providers = customProviders
+
+	scanConfigs := []*ScanConfig{
+		&config.QUIC, &config.TLS, &config.SNI, &config.PING,
+		&config.SOCKS5, &config.SOCKS4, &config.HTTPProxy,
+		&config.H2, &config.TCP, &config.SYN, &config.DoH, &config.DoT, &config.DNS,
+		&config.QUICVN, &config.HTTP, &config.Front,
+		&config.Trace,
+	}
+	// 这些扫描方式使用 ProbeRate 限速, 其他的使用 ConnRate
+	packetConfigs := map[*ScanConfig]bool{
+		&config.PING: true, &config.QUIC: true, &config.QUICVN: true,
+		&config.DNS: true, &config.SYN: true, &config.Trace: true,
+	}
 	for _, scanConfig := range scanConfigs {
 		if strings.HasPrefix(scanConfig.InputFile, "./") {
 			scanConfig.InputFile = filepath.Join(execFolder, scanConfig.InputFile)
@@ -100,6 +250,9 @@ func (gs *GScanner) loadConfig(cfgFile string) error {
 		} else {
 			scanConfig.OutputFile, _ = filepath.Abs(scanConfig.OutputFile)
 		}
+		if strings.HasPrefix(scanConfig.CAFile, "./") {
+			scanConfig.CAFile = filepath.Join(execFolder, scanConfig.CAFile)
+		}
 		if !pathExist(scanConfig.InputFile) {
 			os.Create(scanConfig.InputFile)
 		}
@@ -107,13 +260,99 @@ func (gs *GScanner) loadConfig(cfgFile string) error {
 		scanConfig.ScanMinRTT *= time.Millisecond
 		scanConfig.ScanMaxRTT *= time.Millisecond
 		scanConfig.HandshakeTimeout *= time.Millisecond
+		scanConfig.MaxJitter *= time.Millisecond
+
+		if packetConfigs[scanConfig] {
+			scanConfig.limiter = newRateLimiter(scanConfig.ProbeRate, scanConfig.RateBurst)
+		} else {
+			scanConfig.limiter = newRateLimiter(scanConfig.ConnRate, scanConfig.RateBurst)
+		}
+
+		scanConfig.SortBy = strings.ToLower(scanConfig.SortBy)
+		if _, err := sortKey(scanConfig.SortBy); err != nil {
+			return err
+		}
+
+		if err := scanConfig.parseTlsParams(); err != nil {
+			return fmt.Errorf("invalid tls config: %v", err)
+		}
+		if err := scanConfig.parseDNSParams(); err != nil {
+			return fmt.Errorf("invalid dns config: %v", err)
+		}
+
+		name := strings.ToLower(or(scanConfig.Provider, "google"))
+		if p, ok := config.Providers[name]; ok {
+			scanConfig.provider = p
+		} else if p, ok := providers[name]; ok {
+			scanConfig.provider = p
+		} else {
+			return fmt.Errorf("unknown provider: %s", scanConfig.Provider)
+		}
 	}
-	return nil
+
+	// 设置了 Ports 时IP都带有端口, TCPPorts 不起作用
+	for mode, cfg := range map[string]*ScanConfig{"tcp": &config.TCP, "syn": &config.SYN} {
+		if config.usesMode(mode) && len(cfg.Ports) > 0 && len(cfg.TCPPorts) > 0 {
+			log.Printf("%s: Ports is set, TCPPorts %v is ignored\n", strings.ToUpper(mode), cfg.TCPPorts)
+		}
+	}
+	// SYN 和 QUICVN 共用一个 socket, 打开失败时所有IP都会失败, 载入配置时就报错
+	if config.usesMode("syn") || config.VerifySYN {
+		if _, err := synScan.conn(net.IPv4zero); err != nil {
+			return fmt.Errorf("SYN needs a raw socket (root or CAP_NET_RAW): %v", err)
+		}
+	}
+	if config.usesMode("quicvn") || config.VerifyQuicVN {
+		if _, err := quicVN.conn(net.IPv4zero); err != nil {
+			return fmt.Errorf("QUICVN could not open a UDP socket: %v", err)
+		}
+	}
+	// tcp 和 udp 的跳数测试需要 raw ICMP socket 接收路由器的超时, 没有权限时所有IP都会失败
+	config.Trace.TraceProtocol = strings.ToLower(or(config.Trace.TraceProtocol, "icmp"))
+	switch config.Trace.TraceProtocol {
+	case "icmp":
+	case "tcp", "udp":
+		if config.usesMode("trace") || config.TraceAfterScan {
+			if pc := icmpPinger.conn(net.IPv4zero); pc == nil || !pc.raw {
+				return fmt.Errorf("Trace %s needs a raw ICMP socket (root or CAP_NET_RAW)", config.Trace.TraceProtocol)
+			}
+			if config.Trace.TraceProtocol == "tcp" {
+				if _, err := synScan.conn(net.IPv4zero); err != nil {
+					return fmt.Errorf("Trace tcp needs a raw socket (root or CAP_NET_RAW): %v", err)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown TraceProtocol: %s, should be icmp, tcp or udp", config.Trace.TraceProtocol)
+	}
+	for mode, cfg := range map[string]*ScanConfig{"quic": &config.QUIC, "tls": &config.TLS} {
+		if config.usesMode(mode) && cfg.Level > 2 && cfg.verifyHost() == "" {
+			return fmt.Errorf("%s Level 3 needs HTTPVerifyHosts or a provider with VerifyHosts", strings.ToUpper(mode))
+		}
+	}
+	if config.usesMode("h2") && config.H2.Level > 2 && config.H2.verifyHost() == "" {
+		return errors.New("H2 Level 3 needs HTTPVerifyHosts or a provider with VerifyHosts")
+	}
+	if config.usesMode("doh") && config.DoH.verifyHost() == "" {
+		return errors.New("DoH needs HTTPVerifyHosts or a provider with VerifyHosts")
+	}
+	if config.usesMode("front") {
+		if err := config.Front.checkFront(); err != nil {
+			return err
+		}
+	}
+	return config.buildPipeline()
 }
 
 func main() {
 	var cfgfile string
+	var resume bool
+	var shardFlag string
+	var seedFlag int64
 	flag.StringVar(&cfgfile, "Config File", "./config.json", "Config file, json format")
+	flag.BoolVar(&resume, "resume", false, "Continue the interrupted scan from the checkpoint file")
+	flag.StringVar(&shardFlag, "shard", "", "Only scan shard i of n (i/n, 1 <= i <= n), all shards must use the same seed")
+	flag.Int64Var(&seedFlag, "seed", 0, "Random seed of the scan order and shards, 0 means random when not sharding")
 	flag.Parse()
 
 	scanner := new(GScanner)
@@ -143,83 +382,119 @@ func main() {
 		return
 	}
 
-	scanMode := scanner.ScanMode
-	cfg, _ := scanner.getScanConfig(scanMode)
+	if scanner.shard, err = parseShard(shardFlag); err != nil {
+		log.Println(err)
+		return
+	}
 
-	iprangeFile := cfg.InputFile
-	if !pathExist(iprangeFile) {
-		log.Panicf("IP Range file not exist: %s", iprangeFile)
+	var cp *checkpoint
+	// 分片时所有机器需要使用相同的 seed, 没有设置时使用 0
+	seed := seedFlag
+	if seed == 0 && !scanner.shard.enabled() {
+		seed = time.Now().UnixNano()
+	}
+	if resume {
+		if cp, err = loadCheckpoint(scanner.CheckpointFile); err != nil {
+			log.Panicln(err)
+		}
+		seed = cp.Seed
 	}
 
-	log.Printf("Start loading IP Range file: %s", iprangeFile)
-	ipqueue, err := parseIPRangeFile(iprangeFile)
-	if err != nil {
-		log.Panicln(err)
+	for _, mode := range scanner.ScanMode {
+		p, err := scanner.newScanProfile(mode, seed)
+		if err != nil {
+			log.Panicln(err)
+		}
+		scanner.profiles = append(scanner.profiles, p)
+	}
+	if cp != nil {
+		if err := scanner.resume(cp); err != nil {
+			log.Panicln(err)
+		}
 	}
 
+	if scanner.shard.enabled() {
+		log.Printf("Scanning shard %s with seed %d", scanner.shard, seed)
+	}
 	log.Printf("Start scanning available IP")
 	startTime := time.Now()
-	scanner.StartScan(ipqueue)
+	scanner.StartScan()
+	log.Printf("Scan finished in %s", time.Since(startTime))
 
-	records := scanner.Records()
-
-	log.Printf("Scanned %d IP in %s, found %d records",
-		scanner.ScanCount(), time.Since(startTime), len(records))
-
-	if len(records) == 0 {
-		return
+	// 扫描后的跳数测试可以用 Ctrl-C 中断, 中断后仍然写入结果
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	written := make([]int, len(scanner.profiles))
+	for i, p := range scanner.profiles {
+		written[i] = scanner.output(ctx, p)
 	}
+	stop()
 
-	sort.Slice(records, func(i, j int) bool {
-		return records[i].RTT < records[j].RTT
-	})
-	a := make([]string, len(records))
-	for i, r := range records {
-		a[i] = r.IP
-	}
-	b := new(bytes.Buffer)
-	if cfg.OutputSeparator == "gop" {
-		out := strings.Join(a, `", "`)
-		b.WriteString(`"`)
-		b.WriteString(out)
-		b.WriteString(`",`)
-	} else {
-		out := strings.Join(a, cfg.OutputSeparator)
-		b.WriteString(out)
+	for i, p := range scanner.profiles {
+		log.Printf("%s: scanned %d IP, found %d records, %d written to %s",
+			p.mode, p.ScanCount(), p.RecordSize(), written[i], scanner.shard.fileName(p.config.OutputFile))
 	}
+}
 
-	if err := os.WriteFile(cfg.OutputFile, b.Bytes(), 0o644); err != nil {
-		log.Printf("Failed to write output file:%s for reason: %v", cfg.OutputFile, err)
-	} else {
-		log.Printf("All results written to %s", cfg.OutputFile)
+func (gcfg *GScanner) getScanConfig(scanMode string) (*ScanConfig, testIPFunc) {
+	cfg, testFunc, ok := gcfg.lookupScanConfig(scanMode)
+	if !ok {
+		log.Panicln("Unknown scan mode:", scanMode)
 	}
+	return cfg, testFunc
+}
 
-	if scanner.EnableBackup {
-		filename := fmt.Sprintf("%s_%s_lv%d.txt", scanMode, time.Now().Format("20060102_150405"), cfg.Level)
-
-		bakfilename := filepath.Join(scanner.BackupDir, filename)
-		if err := os.WriteFile(bakfilename, b.Bytes(), 0o644); err != nil {
-			log.Printf("Failed to write output file:%s for reason: %v\n", bakfilename, err)
-		} else {
-			log.Printf("All results written to %s\n", bakfilename)
+// usesMode 返回 ScanMode 或 Pipeline 中是否使用了 mode
+func (gcfg *GScanner) usesMode(mode string) bool {
+	for _, m := range gcfg.ScanMode {
+		if m == mode {
+			return true
 		}
 	}
+	for _, st := range gcfg.Pipeline {
+		if strings.ToLower(st.Mode) == mode {
+			return true
+		}
+	}
+	return false
 }
 
-func (gcfg *GScanner) getScanConfig(scanMode string) (*ScanConfig, testIPFunc) {
+// lookupScanConfig 返回扫描方式的设置和测试函数, 不存在时返回 false
+func (gcfg *GScanner) lookupScanConfig(scanMode string) (*ScanConfig, testIPFunc, bool) {
 	switch scanMode {
 	case "quic":
-		return &gcfg.QUIC, testQuic
+		return &gcfg.QUIC, testQuic, true
 	case "tls":
-		return &gcfg.TLS, testTls
+		return &gcfg.TLS, testTls, true
 	case "sni":
-		return &gcfg.SNI, testSni
+		return &gcfg.SNI, testSni, true
 	case "ping":
-		return &gcfg.PING, testPing
-	// case "socks5":
-	// testIPFunc = testSocks5
-	default:
-		log.Panicln("Unknown scan mode:", scanMode)
+		return &gcfg.PING, testPing, true
+	case "socks5":
+		return &gcfg.SOCKS5, testSocks5, true
+	case "socks4":
+		return &gcfg.SOCKS4, testSocks4, true
+	case "httpproxy":
+		return &gcfg.HTTPProxy, testHTTPProxy, true
+	case "h2":
+		return &gcfg.H2, testH2, true
+	case "tcp":
+		return &gcfg.TCP, testTcp, true
+	case "syn":
+		return &gcfg.SYN, testSyn, true
+	case "doh":
+		return &gcfg.DoH, testDoH, true
+	case "dot":
+		return &gcfg.DoT, testDoT, true
+	case "dns":
+		return &gcfg.DNS, testDns, true
+	case "quicvn":
+		return &gcfg.QUICVN, testQuicVN, true
+	case "http":
+		return &gcfg.HTTP, testHttp, true
+	case "front":
+		return &gcfg.Front, testFront, true
+	case "trace":
+		return &gcfg.Trace, testTrace, true
 	}
-	return nil, nil
+	return nil, nil, false
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func testH2(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	conn, err := dialContext(ctx, "tcp", hostPort(ip, "443"))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	var serverName string
+	if len(config.ServerName) == 0 {
+		serverName = randomHost()
+	} else {
+		serverName = randomChoice(config.ServerName)
+	}
+
+	tlscfg := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+		NextProtos:         []string{http2.NextProtoTLS},
+	}
+	// http2 要求 TLS 1.2 以上, 没有设置时使用 Go 的默认值
+	config.applyTlsParams(tlscfg)
+
+	tlsconn := tls.Client(conn, tlscfg)
+	defer tlsconn.Close()
+
+	tlsconn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+	if err = tlsconn.Handshake(); err != nil {
+		return false
+	}
+
+	// lv1 ALPN 协商为 h2
+	proto := tlsconn.ConnectionState().NegotiatedProtocol
+	if proto != http2.NextProtoTLS {
+		return false
+	}
+	record.SetInfo("alpn", proto)
+
+	// lv2 验证服务商的证书, 并收到服务器的 SETTINGS
+	if config.Level > 1 {
+		if !config.provider.verifyCert(tlsconn.ConnectionState().PeerCertificates) {
+			return false
+		}
+		tlsconn.SetDeadline(start.Add(config.ScanMaxRTT))
+
+		if _, err := tlsconn.Write([]byte(http2.ClientPreface)); err != nil {
+			return false
+		}
+		fr := http2.NewFramer(tlsconn, tlsconn)
+		fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+		if err := fr.WriteSettings(); err != nil {
+			return false
+		}
+
+		// 服务器的第一个帧必须是 SETTINGS
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return false
+		}
+		sf, ok := f.(*http2.SettingsFrame)
+		if !ok || sf.IsAck() {
+			return false
+		}
+		var settings []string
+		sf.ForeachSetting(func(s http2.Setting) error {
+			settings = append(settings, fmt.Sprintf("%s:%d", strings.ToLower(s.ID.String()), s.Val))
+			return nil
+		})
+		record.SetInfo("settings", strings.Join(settings, ","))
+		if err := fr.WriteSettingsAck(); err != nil {
+			return false
+		}
+
+		// lv3 发送 http2 请求, 只有返回 2xx/3xx 才算成功
+		if config.Level > 2 {
+			host := config.verifyHost()
+			if host == "" {
+				return false
+			}
+			status, err := h2Get(fr, host)
+			if err != nil || status < 200 || status >= 400 {
+				return false
+			}
+			record.SetInfo("status", strconv.Itoa(status))
+		}
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+// h2Get 在 stream 1 上发送 GET 请求, 返回响应的状态码
+func h2Get(fr *http2.Framer, host string) (int, error) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: host})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+	enc.WriteField(hpack.HeaderField{Name: "user-agent", Value: "Go-http-client/2.0"})
+	err := fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				fr.WriteSettingsAck()
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				fr.WritePing(true, f.Data)
+			}
+		case *http2.GoAwayFrame:
+			return 0, fmt.Errorf("h2: goaway: %v", f.ErrCode)
+		case *http2.RSTStreamFrame:
+			if f.StreamID == 1 {
+				return 0, fmt.Errorf("h2: rst_stream: %v", f.ErrCode)
+			}
+		case *http2.MetaHeadersFrame:
+			if f.StreamID != 1 {
+				continue
+			}
+			status, err := strconv.Atoi(f.PseudoValue("status"))
+			if err != nil {
+				return 0, fmt.Errorf("h2: bad status: %q", f.PseudoValue("status"))
+			}
+			// 1xx 是中间响应, 继续等待最终响应
+			if status >= 200 {
+				return status, nil
+			}
+		}
+	}
+}
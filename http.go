@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 明文 HTTP 扫描, 端口为 80
+
+func testHttp(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	conn, err := dialContext(ctx, "tcp", hostPort(ip, "80"))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	host := config.verifyHost()
+	if host == "" {
+		host = hostOnly(ip)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+or(config.HTTPPath, "/"), nil)
+	if err != nil {
+		return false
+	}
+	req.Close = true
+
+	conn.SetDeadline(start.Add(config.ScanMaxRTT))
+	if err := req.Write(conn); err != nil {
+		return false
+	}
+
+	// lv1 返回正确的 http 响应
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	record.SetInfo("status", strconv.Itoa(resp.StatusCode))
+	if server := resp.Header.Get("Server"); server != "" {
+		record.SetInfo("server", server)
+	}
+
+	// lv2 验证状态码和响应头
+	if config.Level > 1 && (!config.matchStatus(resp.StatusCode) || !config.matchHeaders(resp.Header)) {
+		return false
+	}
+
+	// lv3 验证响应内容
+	if config.Level > 2 {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		if err != nil || !config.matchBody(body) {
+			return false
+		}
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+// matchStatus 返回状态码是否符合 ExpectStatus, 没有设置时 2xx/3xx 都算符合
+func (sc *ScanConfig) matchStatus(code int) bool {
+	if len(sc.ExpectStatus) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, c := range sc.ExpectStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHeaders 返回响应头是否都包含 ExpectHeaders 的内容
+func (sc *ScanConfig) matchHeaders(h http.Header) bool {
+	for k, v := range sc.ExpectHeaders {
+		if !strings.Contains(h.Get(k), v) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBody 返回响应内容是否包含 ExpectBody
+func (sc *ScanConfig) matchBody(body []byte) bool {
+	return bytes.Contains(body, []byte(sc.ExpectBody))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 未设置 ProxyTarget 时, HTTP 代理 CONNECT 的默认目标
+const defaultHTTPProxyTarget = "www.google.com:443"
+
+var errHTTPProxyConnect = errors.New("httpproxy: connect failed")
+
+func testHTTPProxy(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	conn, err := dialContext(ctx, "tcp", hostPort(ip, "8080"))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+
+	// lv1 CONNECT 返回 200
+	target := or(config.ProxyTarget, defaultHTTPProxyTarget)
+	tunnel, err := httpProxyConnect(conn, target, config.ProxyUsername, config.ProxyPassword)
+	if err != nil {
+		return false
+	}
+
+	// lv2 通过隧道和目标 tls 握手, 并且和 TLS 模式一样验证服务商的证书
+	if config.Level > 1 {
+		host, _, _ := net.SplitHostPort(target)
+		tlsconn := tls.Client(tunnel, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         host,
+		})
+		defer tlsconn.Close()
+
+		tlsconn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+		if err := tlsconn.Handshake(); err != nil {
+			return false
+		}
+		if !config.provider.verifyCert(tlsconn.ConnectionState().PeerCertificates) {
+			return false
+		}
+
+		// lv3 http 测试
+		if config.Level > 2 {
+			verifyHost := config.verifyHost()
+			if verifyHost == "" {
+				verifyHost = host
+			}
+			if !verifyTlsHTTP(tlsconn, "https://"+verifyHost, config.ScanMaxRTT-time.Since(start), config.provider) {
+				return false
+			}
+		}
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+// httpProxyConnect 发送 CONNECT 请求, 成功后返回的连接就是到目标的隧道
+func httpProxyConnect(conn net.Conn, target, username, password string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errHTTPProxyConnect
+	}
+	return &bufferedConn{conn, br}, nil
+}
+
+// bufferedConn 用来读取 bufio.Reader 里剩余的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -2,11 +2,18 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"math/rand"
 	"net"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/mikioh/ipaddr"
 )
@@ -80,12 +87,6 @@ func splitIP(strline string) []ipaddr.Prefix {
 		return nil
 	} else {
 		// "xxx.xxx.xxx.xxx"
-		// 如果IP带有端口, 那么就分离端口
-		if i := strings.LastIndex(strline, ":"); i != -1 {
-			if c, err := ipaddr.Parse(strline[:i]); err == nil {
-				return c.List()
-			}
-		}
 		begin = strline
 		end = strline
 	}
@@ -93,17 +94,44 @@ func splitIP(strline string) []ipaddr.Prefix {
 	return ipaddr.Summarize(net.ParseIP(begin), net.ParseIP(end))
 }
 
+// splitPort 分离出IP段的端口, 没有端口时返回空字符串
+// "xxx.xxx.xxx.xxx:443"
+// "xxx.xxx.xxx.xxx/xx:443"
+// "[xxxx:xxxx::xxxx]:443"
+func splitPort(strline string) (string, string) {
+	if strings.HasPrefix(strline, "[") || strings.Count(strline, ":") == 1 {
+		if host, port, err := net.SplitHostPort(strline); err == nil {
+			if _, err := strconv.ParseUint(port, 10, 16); err == nil {
+				return host, port
+			}
+		}
+	}
+	return strline, ""
+}
+
+// ipRange 是带有端口的IP段, 端口为空时使用扫描方式的默认端口
+type ipRange struct {
+	prefix ipaddr.Prefix
+	port   string
+}
+
 var sepReplacer = strings.NewReplacer(`","`, ",", `", "`, ",", "|", ",")
 
-func parseIPRangeFile(file string) (chan string, error) {
-	f, err := os.Open(file)
+// parseIPRangeFile 读取IP段文件, 返回去重后的IP段和文件内容
+func parseIPRangeFile(file string) ([]ipRange, []byte, error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer f.Close()
 
-	ipranges := make([]ipaddr.Prefix, 0)
-	scanner := bufio.NewScanner(f)
+	ipranges := make([]ipRange, 0)
+	addRange := func(strline string) {
+		strline, port := splitPort(strline)
+		for _, prefix := range splitIP(strline) {
+			ipranges = append(ipranges, ipRange{prefix, port})
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	// 一行最大 4MB
 	buf := make([]byte, 1024*1024*4)
 	scanner.Buffer(buf, len(buf))
@@ -124,40 +152,245 @@ func parseIPRangeFile(file string) (chan string, error) {
 
 		// 支持 gop 的 "xxx","xxx" 和 goa 的 xxx|xxx 格式
 		if s := sepReplacer.Replace(line); strings.Contains(s, ",") {
-			if c, err := ipaddr.Parse(s); err == nil {
-				ipranges = append(ipranges, c.List()...)
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					addRange(item)
+				}
 			}
 		} else {
-			ipranges = append(ipranges, splitIP(line)...)
+			addRange(line)
 		}
 	}
+	if len(ipranges) > 0 {
+		ipranges = dedup(ipranges)
+	}
+	return ipranges, data, nil
+}
 
+// ipFeeder 按顺序生成要扫描的地址
+// 所有IP段轮流取一个IP, IP段内也按子网轮流取, 不再一个IP段扫描完毕再进行下一个
+// 这样同一时间扫描的IP分散在不同的子网, 不容易触发目标网络的限制
+// 扫描位置可以保存到 checkpoint, 中断后从这里继续
+type ipFeeder struct {
+	mu     sync.Mutex
+	ports  []int
+	seed   int64
+	shard  shard
+	hash   string
+	ranges []ipRange
+	iters  []*subnetIter
+	// 还没有遍历完的IP段, 按轮流的顺序, pos 是下一个要取的
+	order []int
+	pos   int
+	// 已经发出但是还没有扫描完的地址
+	pending map[string]int
+	// 从 checkpoint 恢复的, 需要先扫描
+	resumed []string
+}
+
+// newIPFeeder 读取IP段文件, 使用 seed 打乱IP段的顺序
+// 如果IP段没有端口, 并且设置了 ports, 那么每个端口都会扫描一次
+// v4Bits、v6Bits 是按子网轮流扫描时子网的大小, 分片时只生成属于 sh 的IP
+func newIPFeeder(file string, ports []int, v4Bits, v6Bits int, seed int64, sh shard) (*ipFeeder, error) {
+	ipranges, data, err := parseIPRangeFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// 打乱IP段扫描顺序
+	rnd := rand.New(rand.NewSource(seed))
+	rnd.Shuffle(len(ipranges), func(i, j int) {
+		ipranges[i], ipranges[j] = ipranges[j], ipranges[i]
+	})
+
+	// 影响扫描顺序的都要算进去, 不同时不能从 checkpoint 继续
+	h := sha256.New()
+	h.Write(data)
+	fmt.Fprint(h, ports, v4Bits, v6Bits, sh)
+
+	f := &ipFeeder{
+		ports:   ports,
+		seed:    seed,
+		shard:   sh,
+		hash:    hex.EncodeToString(h.Sum(nil)),
+		ranges:  ipranges,
+		iters:   make([]*subnetIter, len(ipranges)),
+		order:   make([]int, len(ipranges)),
+		pending: make(map[string]int),
+	}
+	for i, r := range ipranges {
+		f.iters[i] = newSubnetIter(r, v4Bits, v6Bits)
+		f.order[i] = i
+	}
+	return f, nil
+}
+
+// next 返回下一个IP的所有地址, 没有时返回 nil
+// 返回的地址会记为正在扫描, 扫描完后需要调用 done
+func (f *ipFeeder) next() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.order) > 0 {
+		if f.pos >= len(f.order) {
+			f.pos = 0
+		}
+		i := f.order[f.pos]
+		ip, ok := f.iters[i].next()
+		if !ok {
+			f.order[f.pos] = f.order[len(f.order)-1]
+			f.order = f.order[:len(f.order)-1]
+			continue
+		}
+		f.pos++
+		if !f.shard.has(ip, f.seed) {
+			continue
+		}
+
+		var addrs []string
+		switch port := f.ranges[i].port; {
+		case port != "":
+			addrs = []string{net.JoinHostPort(ip.String(), port)}
+		case len(f.ports) > 0:
+			for _, port := range f.ports {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			}
+		default:
+			addrs = []string{ip.String()}
+		}
+		for _, addr := range addrs {
+			f.pending[addr]++
+		}
+		return addrs
+	}
+	return nil
+}
+
+// done 表示地址已经扫描完, 中断的扫描不要调用
+func (f *ipFeeder) done(addr string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	if f.pending[addr]--; f.pending[addr] <= 0 {
+		delete(f.pending, addr)
+	}
+	f.mu.Unlock()
+}
+
+// start 开始生成地址, 先发送从 checkpoint 恢复的
+func (f *ipFeeder) start() chan string {
 	out := make(chan string, 200)
 	go func() {
 		defer close(out)
-		if len(ipranges) > 0 {
-			ipranges = dedup(ipranges)
-
-			// 打乱IP段扫描顺序
-			rand.Shuffle(len(ipranges), func(i, j int) {
-				ipranges[i], ipranges[j] = ipranges[j], ipranges[i]
-			})
-
-			// 打乱IP的扫描顺序, 不再等待一个IP段扫描完毕再进行下一个, 提高扫描的随机性
-			// 有时候可以更快的扫到IP
-			n := 15
-			if len(ipranges) < n {
-				n = len(ipranges)
+		for _, addr := range f.resumed {
+			out <- addr
+		}
+		for addrs := f.next(); addrs != nil; addrs = f.next() {
+			for _, addr := range addrs {
+				out <- addr
 			}
-			ops(len(ipranges), n, func(i, _ int) {
-				c := ipaddr.NewCursor([]ipaddr.Prefix{ipranges[i]})
-				for ip := c.First(); ip != nil; ip = c.Next() {
-					out <- ip.IP.String()
-				}
-			})
 		}
 	}()
-	return out, nil
+	return out
+}
+
+// subnetIter 按子网轮流遍历一个IP段, 先取每个子网的第一个IP, 再取每个子网的第二个, 以此类推
+// 子网大小为 IPv4 /v4Bits, IPv6 /v6Bits, IP段比子网小时就是按顺序遍历
+type subnetIter struct {
+	port string
+	v4   bool
+	base uint128
+	// 子网数和子网大小的位数
+	kbits, sbits int
+	// 当前的子网和子网内的序号
+	k, j uint128
+	done bool
+}
+
+func newSubnetIter(r ipRange, v4Bits, v6Bits int) *subnetIter {
+	it := &subnetIter{port: r.port}
+	width, sub := 128, v6Bits
+	ip := r.prefix.IP.To16()
+	if ip4 := r.prefix.IP.To4(); ip4 != nil {
+		it.v4, width, sub = true, 32, v4Bits
+		ip = ip4
+	}
+	it.base = uint128FromIP(ip)
+	n := r.prefix.Len()
+	it.kbits = max(sub-n, 0)
+	it.sbits = width - max(n, sub)
+	return it
+}
+
+func (it *subnetIter) next() (net.IP, bool) {
+	if it.done {
+		return nil, false
+	}
+	a := it.base.or(it.k.shl(it.sbits)).or(it.j)
+	it.k = it.k.inc()
+	if !it.k.fits(it.kbits) {
+		it.k = uint128{}
+		if it.j = it.j.inc(); !it.j.fits(it.sbits) {
+			it.done = true
+		}
+	}
+	return a.ip(it.v4), true
+}
+
+// uint128 用于计算 IPv6 地址
+type uint128 struct {
+	hi, lo uint64
+}
+
+func uint128FromIP(ip net.IP) uint128 {
+	if len(ip) == net.IPv4len {
+		return uint128{lo: uint64(binary.BigEndian.Uint32(ip))}
+	}
+	return uint128{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}
+}
+
+func (u uint128) ip(v4 bool) net.IP {
+	if v4 {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(u.lo))
+		return ip
+	}
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], u.hi)
+	binary.BigEndian.PutUint64(ip[8:], u.lo)
+	return ip
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{u.hi | v.hi, u.lo | v.lo}
+}
+
+func (u uint128) inc() uint128 {
+	if u.lo++; u.lo == 0 {
+		u.hi++
+	}
+	return u
+}
+
+func (u uint128) shl(n int) uint128 {
+	switch {
+	case n >= 128:
+		return uint128{}
+	case n >= 64:
+		return uint128{u.lo << (n - 64), 0}
+	}
+	return uint128{u.hi<<n | u.lo>>(64-n), u.lo << n}
+}
+
+// fits 返回 u 是否小于 2^bits
+func (u uint128) fits(bits int) bool {
+	switch {
+	case bits >= 128:
+		return true
+	case bits >= 64:
+		return u.hi>>(bits-64) == 0
+	}
+	return u.hi == 0 && u.lo>>bits == 0
 }
 
 /*
@@ -184,14 +417,18 @@ IP段去重	(此描述对当前算法不适用-2017/09/21)
 
 [1.9.0.0/16 3.3.0.0/16 1.1.1.0/24 203.0.113.0/24 2001:db8::1/128]
 */
-func dedup(s []ipaddr.Prefix) []ipaddr.Prefix {
+func dedup(s []ipRange) []ipRange {
+	// 端口不同的IP段分开去重
 	sort.Slice(s, func(i int, j int) bool {
-		return s[i].String() < s[j].String()
+		if s[i].port != s[j].port {
+			return s[i].port < s[j].port
+		}
+		return s[i].prefix.String() < s[j].prefix.String()
 	})
 	out := s[:1]
 	t := s[0]
 	for _, s := range s[1:] {
-		if !t.Contains(&s) && !t.Equal(&s) {
+		if s.port != t.port || (!t.prefix.Contains(&s.prefix) && !t.prefix.Equal(&s.prefix)) {
 			out = append(out, s)
 			t = s
 		}
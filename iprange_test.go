@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSplitPort(t *testing.T) {
+	tests := []struct {
+		in, host, port string
+	}{
+		{"1.9.22.0", "1.9.22.0", ""},
+		{"1.9.22.0:443", "1.9.22.0", "443"},
+		{"1.9.22.0/24:8443", "1.9.22.0/24", "8443"},
+		{"[2001:db8::1]:2053", "2001:db8::1", "2053"},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"2001:db8::/32", "2001:db8::/32", ""},
+		// 端口不合法时当作没有端口
+		{"1.9.22.0:99999", "1.9.22.0:99999", ""},
+		{"1.9.22.0:http", "1.9.22.0:http", ""},
+	}
+	for _, tt := range tests {
+		host, port := splitPort(tt.in)
+		if host != tt.host || port != tt.port {
+			t.Errorf("splitPort(%q) = %q, %q, want %q, %q", tt.in, host, port, tt.host, tt.port)
+		}
+	}
+}
+
+// iterIPs 遍历 s 的IP段, 最多取 limit 个
+func iterIPs(t *testing.T, s string, v4Bits, v6Bits, limit int) []string {
+	t.Helper()
+	prefixes := splitIP(s)
+	if len(prefixes) != 1 {
+		t.Fatalf("splitIP(%q) returned %d prefixes", s, len(prefixes))
+	}
+	it := newSubnetIter(ipRange{prefix: prefixes[0]}, v4Bits, v6Bits)
+	var ips []string
+	for len(ips) < limit {
+		ip, ok := it.next()
+		if !ok {
+			break
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+func TestSubnetIterOrder(t *testing.T) {
+	tests := []struct {
+		in             string
+		v4Bits, v6Bits int
+		want           []string
+	}{
+		// 每个 /24 轮流取一个
+		{"10.0.0.0/22", 24, 48, []string{"10.0.0.0", "10.0.1.0", "10.0.2.0", "10.0.3.0", "10.0.0.1", "10.0.1.1"}},
+		{"2001:db8::/120", 48, 124, []string{"2001:db8::", "2001:db8::10", "2001:db8::20"}},
+		// IP段比子网小时按顺序遍历
+		{"10.0.0.0/30", 24, 48, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"10.0.0.7/32", 24, 48, []string{"10.0.0.7"}},
+		{"2001:db8::1/128", 24, 48, []string{"2001:db8::1"}},
+		// 整个地址空间
+		{"0.0.0.0/0", 24, 48, []string{"0.0.0.0", "0.0.1.0", "0.0.2.0"}},
+		{"::/0", 24, 48, []string{"::", "0:0:1::", "0:0:2::"}},
+	}
+	for _, tt := range tests {
+		got := iterIPs(t, tt.in, tt.v4Bits, tt.v6Bits, len(tt.want))
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSubnetIterCoverage(t *testing.T) {
+	tests := []struct {
+		in             string
+		v4Bits, v6Bits int
+		n              int
+	}{
+		{"10.0.0.0/22", 24, 48, 1024},
+		{"10.0.0.0/22", 32, 48, 1024},
+		{"10.0.0.0/22", 0, 48, 1024},
+		{"10.0.0.0/30", 24, 48, 4},
+		{"10.0.0.7/32", 24, 48, 1},
+		{"2001:db8::/118", 24, 120, 1024},
+		{"2001:db8::/118", 24, 128, 1024},
+	}
+	for _, tt := range tests {
+		_, ipnet, _ := net.ParseCIDR(tt.in)
+		ips := iterIPs(t, tt.in, tt.v4Bits, tt.v6Bits, tt.n+1)
+		if len(ips) != tt.n {
+			t.Errorf("%s /%d /%d: got %d IPs, want %d", tt.in, tt.v4Bits, tt.v6Bits, len(ips), tt.n)
+		}
+		seen := make(map[string]bool, len(ips))
+		for _, s := range ips {
+			if seen[s] {
+				t.Errorf("%s: duplicate IP %s", tt.in, s)
+			}
+			seen[s] = true
+			if !ipnet.Contains(net.ParseIP(s)) {
+				t.Errorf("%s: IP %s out of range", tt.in, s)
+			}
+		}
+	}
+}
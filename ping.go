@@ -12,14 +12,25 @@ import (
 	"errors"
 	"net"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func testPing(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
 	start := time.Now()
-	if err := Pinger(ip, config.ScanMaxRTT); err != nil {
+	ttl, err := Pinger(hostOnly(ip), config.ScanMaxRTT)
+	if err != nil {
 		return false
 	}
+	if ttl > 0 {
+		record.SetInfo("ttl", strconv.Itoa(ttl))
+	}
 	if rtt := time.Since(start); rtt > config.ScanMinRTT {
 		record.RTT += rtt
 		return true
@@ -32,9 +43,20 @@ const (
 	icmpv4EchoReply   = 0
 	icmpv6EchoRequest = 128
 	icmpv6EchoReply   = 129
+
+	icmpv4DestinationUnreachable = 3
+	icmpv6DestinationUnreachable = 1
+	icmpv4TimeExceeded           = 11
+	icmpv6TimeExceeded           = 3
 )
 
-var ErrPingConnFailed = errors.New("ping: connect failed")
+var (
+	ErrPingConnFailed   = errors.New("ping: connect failed")
+	ErrPingUnreachable  = errors.New("ping: destination unreachable")
+	ErrPingTimeExceeded = errors.New("ping: time exceeded")
+	// UDP 探测到达目标时, 目标回复端口不可达
+	ErrPingPortUnreachable = errors.New("ping: port unreachable")
+)
 
 type icmpMessage struct {
 	Type     int             // type
@@ -136,69 +158,292 @@ func parseICMPEcho(b []byte) (*icmpEcho, error) {
 }
 
 func Ping(address string, timeout time.Duration) error {
-	return Pinger(address, timeout)
+	_, err := Pinger(address, timeout)
+	return err
 }
 
-func Pinger(address string, timeout time.Duration) error {
-	typ := icmpv4EchoRequest
-	network := "ip4:icmp"
-
-	isIpv6 := false
-	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
-		typ = icmpv6EchoRequest
-		network = "ip6:ipv6-icmp"
-		isIpv6 = true
+// Pinger 发送一个 echo 请求, 返回回复的 TTL (IPv6 为 Hop Limit)
+func Pinger(address string, timeout time.Duration) (int, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return 0, ErrPingConnFailed
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r, err := icmpPinger.probe(ctx, ip, 0)
+	return r.ttl, noteNetError(err)
+}
+
+var icmpPinger = &pinger{pending: make(map[string]chan pingReply)}
+
+// pinger 所有的 ping 共用一个 ICMP socket (IPv4 和 IPv6 各一个)
+// 回复按来源地址和序号分发给对应的 ping
+// trace 需要指定 TTL, 发送时临时修改共用 socket 的 TTL, 见 ttlConn
+type pinger struct {
+	once4, once6 sync.Once
+	conn4, conn6 *pingConn
+
+	seq uint32
+
+	mu sync.Mutex
+	// key 为目标地址和序号, trace 的 TCP 和 UDP 探测也通过这里接收超时和不可达
+	pending map[string]chan pingReply
+}
+
+type pingReply struct {
+	// 回复的 TTL
+	ttl int
+	// 回复的来源, 超时和不可达时是路由器的地址
+	from net.IP
+	err  error
+}
+
+type pingConn struct {
+	ttlConn
+	// 为 false 时是 udp ping socket, 内核会把 ID 改成自己分配的, 所以只匹配序号
+	// udp ping socket 收不到 ICMP 不可达和超时, 只能等待超时
+	raw bool
+	id  int
+}
 
-	c, err := net.Dial(network, address)
+func listenPing(v6 bool) *pingConn {
+	network, udpNetwork, addr := "ip4:icmp", "udp4", "0.0.0.0"
+	if v6 {
+		network, udpNetwork, addr = "ip6:ipv6-icmp", "udp6", "::"
+	}
+	pc := &pingConn{raw: true, id: os.Getpid() & 0xffff}
+	c, err := icmp.ListenPacket(network, addr)
 	if err != nil {
-		return ErrPingConnFailed
+		// 没有 raw socket 权限时使用 Linux 的 udp ping socket
+		// 需要 net.ipv4.ping_group_range 包含当前用户的组
+		if c, err = icmp.ListenPacket(udpNetwork, addr); err != nil {
+			return nil
+		}
+		pc.raw = false
+	}
+	pc.c = c
+	if v6 {
+		pc.p6 = c.IPv6PacketConn()
+		pc.p6.SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		pc.p4 = c.IPv4PacketConn()
+		pc.p4.SetControlMessage(ipv4.FlagTTL, true)
+	}
+	return pc
+}
+
+// conn 返回 ip 对应地址族的 socket, 每个地址族只打开一次, 打开失败时返回 nil, 不再重试
+func (p *pinger) conn(ip net.IP) *pingConn {
+	if ip.To4() != nil {
+		p.once4.Do(func() { p.conn4 = p.listen(false) })
+		return p.conn4
+	}
+	p.once6.Do(func() { p.conn6 = p.listen(true) })
+	return p.conn6
+}
+
+func (p *pinger) listen(v6 bool) *pingConn {
+	pc := listenPing(v6)
+	if pc != nil {
+		go p.readLoop(pc)
+	}
+	return pc
+}
+
+func pingKey(ip net.IP, seq int) string {
+	return ip.String() + "/" + strconv.Itoa(seq)
+}
+
+// tcpReplyKey 和 udpReplyKey 是 trace 的 TCP 和 UDP 探测的 key
+// 路由器的超时和目标的不可达附带了原始包的头, 通过目标地址、端口和 TCP 序号区分
+func tcpReplyKey(ip net.IP, sport, dport int, seq uint32) string {
+	return "tcp/" + ip.String() + "/" + strconv.Itoa(sport) + "/" + strconv.Itoa(dport) + "/" + strconv.FormatUint(uint64(seq), 10)
+}
+
+func udpReplyKey(ip net.IP, sport, dport int) string {
+	return "udp/" + ip.String() + "/" + strconv.Itoa(sport) + "/" + strconv.Itoa(dport)
+}
+
+// expect 注册 key, 返回接收回复的 channel 和取消注册的函数
+// 需要在发送前注册, 不然可能错过回复
+func (p *pinger) expect(key string) (<-chan pingReply, func()) {
+	ch := make(chan pingReply, 1)
+	p.mu.Lock()
+	p.pending[key] = ch
+	p.mu.Unlock()
+	return ch, func() {
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+	}
+}
+
+// probe 发送一个 echo 请求, ttl 为 0 时使用系统默认的 TTL
+func (p *pinger) probe(ctx context.Context, ip net.IP, ttl int) (pingReply, error) {
+	pc := p.conn(ip)
+	if pc == nil {
+		return pingReply{}, ErrPingConnFailed
 	}
-	defer c.Close()
-	deadline := time.Now().Add(timeout)
-	c.SetReadDeadline(deadline)
 
-	xid, xseq := os.Getpid()&0xffff, 1
+	typ := icmpv4EchoRequest
+	if pc.p6 != nil {
+		typ = icmpv6EchoRequest
+	}
+	seq := int(atomic.AddUint32(&p.seq, 1) & 0xffff)
 	wb, err := (&icmpMessage{
 		Type: typ, Code: 0,
 		Body: &icmpEcho{
-			ID: xid, Seq: xseq,
+			ID: pc.id, Seq: seq,
 			Data: bytes.Repeat([]byte("Go Go Gadget Ping!!!"), 3),
 		},
 	}).Marshal()
 	if err != nil {
-		return err
+		return pingReply{}, err
+	}
+
+	ch, cancel := p.expect(pingKey(ip, seq))
+	defer cancel()
+
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if !pc.raw {
+		dst = &net.UDPAddr{IP: ip}
 	}
-	if _, err = c.Write(wb); err != nil {
-		return err
+	if err := pc.writeTo(wb, dst, ttl); err != nil {
+		return pingReply{}, noteNetError(err)
 	}
-	var m *icmpMessage
-	rb := make([]byte, 20+len(wb))
+
+	select {
+	case <-ctx.Done():
+		return pingReply{}, ctx.Err()
+	case r := <-ch:
+		return r, r.err
+	}
+}
+
+func (p *pinger) readLoop(pc *pingConn) {
+	b := make([]byte, 1500)
 	for {
-		// read_timeout := deadline.Sub(time.Now())
-		// c.SetReadDeadline(time.Now().Add(read_timeout))
-		if _, err = c.Read(rb); err != nil {
-			return err
-		}
-		if !isIpv6 {
-			rb = ipv4Payload(rb)
+		var (
+			n    int
+			ttl  int
+			peer net.Addr
+			err  error
+		)
+		if pc.p6 != nil {
+			var cm *ipv6.ControlMessage
+			n, cm, peer, err = pc.p6.ReadFrom(b)
+			if cm != nil {
+				ttl = cm.HopLimit
+			}
+		} else {
+			var cm *ipv4.ControlMessage
+			n, cm, peer, err = pc.p4.ReadFrom(b)
+			if cm != nil {
+				ttl = cm.TTL
+			}
 		}
-		if m, err = parseICMPMessage(rb); err != nil {
-			return err
+		if err != nil {
+			return
 		}
-		switch m.Type {
-		case icmpv4EchoRequest, icmpv6EchoRequest:
+
+		key, r, ok := pc.parseReply(b[:n], peer)
+		if !ok {
 			continue
 		}
-		break
+		r.ttl = ttl
+		p.mu.Lock()
+		ch, ok := p.pending[key]
+		p.mu.Unlock()
+		if ok {
+			select {
+			case ch <- r:
+			default:
+			}
+		}
 	}
-	return nil
 }
 
-func ipv4Payload(b []byte) []byte {
-	if len(b) < 20 {
-		return b
+// parseReply 解析 echo 回复、不可达和超时, 返回对应 ping 或 trace 探测的 key
+// raw socket 会收到所有的 ICMP 包, 其他 socket 的回复也会收到, 通过 pending 去掉重复的
+func (pc *pingConn) parseReply(b []byte, peer net.Addr) (string, pingReply, bool) {
+	if len(b) < 8 {
+		return "", pingReply{}, false
+	}
+	var from net.IP
+	switch addr := peer.(type) {
+	case *net.IPAddr:
+		from = addr.IP
+	case *net.UDPAddr:
+		from = addr.IP
+	default:
+		return "", pingReply{}, false
+	}
+
+	v6, typ := pc.p6 != nil, int(b[0])
+	var err error
+	switch {
+	case !v6 && typ == icmpv4EchoReply, v6 && typ == icmpv6EchoReply:
+		m, err := parseICMPMessage(b)
+		if err != nil {
+			return "", pingReply{}, false
+		}
+		echo, ok := m.Body.(*icmpEcho)
+		if !ok || (pc.raw && echo.ID != pc.id) {
+			return "", pingReply{}, false
+		}
+		return pingKey(from, echo.Seq), pingReply{from: from}, true
+	case !v6 && typ == icmpv4DestinationUnreachable, v6 && typ == icmpv6DestinationUnreachable:
+		err = ErrPingUnreachable
+	case !v6 && typ == icmpv4TimeExceeded, v6 && typ == icmpv6TimeExceeded:
+		err = ErrPingTimeExceeded
+	default:
+		return "", pingReply{}, false
+	}
+
+	// 不可达和超时的来源是路由器, 需要从附带的原始包中取出目标地址和原来的请求
+	// 原始包是 echo 请求时按序号分发, 是 trace 的 TCP 或 UDP 探测时按端口和序号分发
+	var dst net.IP
+	var proto int
+	var orig []byte
+	if v6 {
+		if len(b) < 8+ipv6.HeaderLen+8 {
+			return "", pingReply{}, false
+		}
+		proto = int(b[8+6])
+		dst = net.IP(b[8+24 : 8+40])
+		orig = b[8+ipv6.HeaderLen:]
+	} else {
+		if len(b) < 8+ipv4.HeaderLen {
+			return "", pingReply{}, false
+		}
+		hdrlen := int(b[8]&0x0f) << 2
+		if len(b) < 8+hdrlen+8 {
+			return "", pingReply{}, false
+		}
+		proto = int(b[8+9])
+		dst = net.IP(b[8+16 : 8+20])
+		orig = b[8+hdrlen:]
+	}
+	sport, dport := int(orig[0])<<8|int(orig[1]), int(orig[2])<<8|int(orig[3])
+	switch proto {
+	case 1, 58: // ICMP, ICMPv6
+		if v6 != (proto == 58) {
+			return "", pingReply{}, false
+		}
+		id, seq := int(orig[4])<<8|int(orig[5]), int(orig[6])<<8|int(orig[7])
+		if pc.raw && id != pc.id {
+			return "", pingReply{}, false
+		}
+		return pingKey(dst, seq), pingReply{from: from, err: err}, true
+	case 6: // TCP
+		seq := uint32(orig[4])<<24 | uint32(orig[5])<<16 | uint32(orig[6])<<8 | uint32(orig[7])
+		return tcpReplyKey(dst, sport, dport, seq), pingReply{from: from, err: err}, true
+	case 17: // UDP
+		code := int(b[1])
+		if err == ErrPingUnreachable && (!v6 && code == 3 || v6 && code == 4) {
+			err = ErrPingPortUnreachable
+		}
+		return udpReplyKey(dst, sport, dport), pingReply{from: from, err: err}, true
 	}
-	hdrlen := int(b[0]&0x0f) << 2
-	return b[hdrlen:]
+	return "", pingReply{}, false
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 多阶段扫描, 每个阶段有自己的扫描线程, 通过的IP送到下一个阶段, 最后一个阶段是 ScanMode
+// 同时扫描多个扫描方式时, 前面的阶段是共用的
+// 先用 ping、tcp 这些开销小的测试过滤掉大部分IP, 可以减少 QUIC、HTTP 等耗时的测试
+// VerifyPing、VerifySYN、VerifyTCP、VerifyQuicVN 会作为最前面的几个阶段
+
+// PipelineStage 是 Pipeline 中的一个阶段, 使用 Mode 对应的扫描设置
+type PipelineStage struct {
+	Mode string
+	// 这个阶段的扫描线程数, 0 时使用 ScanWorker
+	Workers int
+	// 不为 0 时覆盖扫描设置中的值
+	Level            int
+	ScanMaxRTT       time.Duration
+	HandshakeTimeout time.Duration
+	// 每秒最多测试的IP数, 0 时使用扫描设置中的 ConnRate 或 ProbeRate
+	Rate int
+}
+
+type scanStage struct {
+	name     string
+	config   *ScanConfig
+	testFunc testIPFunc
+	workers  int
+
+	// 进入和通过这个阶段的IP数, 被中断的不算
+	in     int32
+	passed int32
+}
+
+func newScanStage(name string, config *ScanConfig, testFunc testIPFunc, workers int) *scanStage {
+	if config.Level > 0 {
+		name = fmt.Sprintf("%s(lv%d)", name, config.Level)
+	}
+	return &scanStage{
+		name:     name,
+		config:   config,
+		testFunc: testFunc,
+		workers:  workers,
+	}
+}
+
+func (s *scanStage) count(passed bool) {
+	atomic.AddInt32(&s.in, 1)
+	if passed {
+		atomic.AddInt32(&s.passed, 1)
+	}
+}
+
+func (s *scanStage) String() string {
+	return fmt.Sprintf("%s %d -> %d", s.name, atomic.LoadInt32(&s.in), atomic.LoadInt32(&s.passed))
+}
+
+// buildPipeline 按 Verify* 和 Pipeline 设置生成扫描前的阶段, 需要在扫描设置的单位转换后调用
+func (gs *GScanner) buildPipeline() error {
+	gs.stages = nil
+	if gs.VerifyPing {
+		cfg := gs.PING
+		cfg.Level = 0
+		cfg.ScanMinRTT, cfg.ScanMaxRTT = gs.ScanMinPingRTT, gs.ScanMaxPingRTT
+		gs.stages = append(gs.stages, newScanStage("ping", &cfg, testPing, gs.ScanWorker))
+	}
+	if gs.VerifySYN {
+		gs.stages = append(gs.stages, newScanStage("syn", &gs.SYN, testSyn, gs.ScanWorker))
+	}
+	if gs.VerifyTCP {
+		gs.stages = append(gs.stages, newScanStage("tcp", &gs.TCP, testTcp, gs.ScanWorker))
+	}
+	if gs.VerifyQuicVN {
+		gs.stages = append(gs.stages, newScanStage("quicvn", &gs.QUICVN, testQuicVN, gs.ScanWorker))
+	}
+
+	for _, st := range gs.Pipeline {
+		mode := strings.ToLower(st.Mode)
+		base, testFunc, ok := gs.lookupScanConfig(mode)
+		if !ok {
+			return fmt.Errorf("unknown pipeline scan mode: %s", st.Mode)
+		}
+		// 复制一份, 不影响 ScanMode 使用的设置, 限速默认和这个扫描方式共用
+		cfg := *base
+		cfg.Level = or(st.Level, cfg.Level)
+		cfg.ScanMaxRTT = or(st.ScanMaxRTT*time.Millisecond, cfg.ScanMaxRTT)
+		cfg.HandshakeTimeout = or(st.HandshakeTimeout*time.Millisecond, cfg.HandshakeTimeout)
+		if st.Rate > 0 {
+			cfg.limiter = newRateLimiter(st.Rate, cfg.RateBurst)
+		}
+		gs.stages = append(gs.stages, newScanStage(mode, &cfg, testFunc, or(st.Workers, gs.ScanWorker)))
+	}
+	return nil
+}
+
+// startStages 启动扫描前的各个阶段, 返回最后一个阶段的输出
+// 各阶段在输入关闭或 ctx 结束后退出, 退出时关闭输出, wg 等待所有阶段退出
+func (gs *GScanner) startStages(ctx context.Context, queue <-chan scanJob, wg *sync.WaitGroup) <-chan scanJob {
+	for _, s := range gs.stages {
+		out := make(chan scanJob, s.workers)
+		wg.Add(1)
+		go func(s *scanStage, in <-chan scanJob) {
+			defer wg.Done()
+			defer close(out)
+			ops(s.workers, s.workers, func(i, thread int) {
+				gs.stageWorker(ctx, s, in, out)
+			})
+		}(s, queue)
+		queue = out
+	}
+	return queue
+}
+
+func (gs *GScanner) stageWorker(ctx context.Context, s *scanStage, in <-chan scanJob, out chan<- scanJob) {
+	for {
+		var job scanJob
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case job, ok = <-in:
+			if !ok {
+				return
+			}
+		}
+		// 达到 RecordLimit 的扫描方式不再测试
+		if job.p.stopped.Load() {
+			continue
+		}
+
+		passed := gs.testStage(ctx, s, job.ip)
+		if !passed && ctx.Err() != nil {
+			// 被中断的没有测试完, 不记为扫描完, checkpoint 继续时会重新扫描
+			return
+		}
+		s.count(passed)
+		if !passed {
+			job.p.feeder.done(job.ip)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case out <- job:
+		}
+	}
+}
+
+// testStage 测试一次, 不记录结果
+func (gs *GScanner) testStage(ctx context.Context, s *scanStage, ip string) bool {
+	subnet, ok := gs.subnets.acquire(ctx, ip)
+	if !ok {
+		return false
+	}
+	defer gs.subnets.release(subnet)
+
+	if s.config.limiter.wait(ctx) != nil {
+		return false
+	}
+	return s.testFunc(ctx, ip, s.config, new(ScanRecord))
+}
+
+// logFunnel 输出每个阶段进入和通过的IP数, 最后是各扫描方式的
+func logFunnel(stages []*scanStage, profiles []*scanProfile) {
+	a := make([]string, 0, len(stages)+len(profiles))
+	for _, s := range stages {
+		a = append(a, s.String())
+	}
+	for _, p := range profiles {
+		a = append(a, p.final.String())
+	}
+	log.Printf("Pipeline: %s\n", strings.Join(a, ", "))
+}
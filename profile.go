@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scanModes 是要扫描的扫描方式, 配置文件中可以是一个字符串, 也可以是列表
+type scanModes []string
+
+func (m *scanModes) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		*m = scanModes{mode}
+		return nil
+	}
+	var modes []string
+	if err := json.Unmarshal(data, &modes); err != nil {
+		return err
+	}
+	*m = modes
+	return nil
+}
+
+// only 返回是否只扫描 mode
+func (m scanModes) only(mode string) bool {
+	return len(m) == 1 && m[0] == mode
+}
+
+func (m scanModes) String() string {
+	return strings.Join(m, ",")
+}
+
+// scanProfile 是 ScanMode 中的一个扫描方式, 有自己的IP段文件、记录和输出
+// 多个扫描方式同时扫描时, 共用扫描线程和扫描前的阶段
+type scanProfile struct {
+	ScanRecords
+	mode   string
+	config *ScanConfig
+	feeder *ipFeeder
+	// 测试函数和进入、通过的IP数
+	final *scanStage
+	// 达到 RecordLimit 后不再扫描
+	stopped atomic.Bool
+	// 扫描完一个IP时添加记录、增加计数和标记扫描完都持有这个锁
+	// 保存 checkpoint 时也持有, 这样记录和 feeder 的进度是一致的
+	progress sync.Mutex
+}
+
+// scanJob 是一个要扫描的IP和它的扫描方式
+type scanJob struct {
+	p  *scanProfile
+	ip string
+}
+
+func (gs *GScanner) newScanProfile(mode string, seed int64) (*scanProfile, error) {
+	cfg, testFunc := gs.getScanConfig(mode)
+	if !pathExist(cfg.InputFile) {
+		return nil, fmt.Errorf("IP Range file not exist: %s", cfg.InputFile)
+	}
+
+	log.Printf("Start loading IP Range file: %s", cfg.InputFile)
+	feeder, err := newIPFeeder(cfg.InputFile, cfg.Ports, gs.SubnetPrefixV4, gs.SubnetPrefixV6, seed, gs.shard)
+	if err != nil {
+		return nil, err
+	}
+	p := &scanProfile{
+		mode:   mode,
+		config: cfg,
+		feeder: feeder,
+		final:  newScanStage(mode, cfg, testFunc, 0),
+	}
+	if len(gs.ScanMode) > 1 {
+		p.name = mode
+	}
+	return p, nil
+}
+
+// jobs 轮流从每个扫描方式取一个IP, 达到 RecordLimit 的不再取, 全部取完后关闭
+func (gs *GScanner) jobs(ctx context.Context) <-chan scanJob {
+	out := make(chan scanJob)
+	go func() {
+		defer close(out)
+		queues := make([]<-chan string, len(gs.profiles))
+		for i, p := range gs.profiles {
+			queues[i] = p.feeder.start()
+		}
+		for open := len(queues); open > 0; {
+			for i, q := range queues {
+				if q == nil {
+					continue
+				}
+				p := gs.profiles[i]
+				ip, ok := "", false
+				if !p.stopped.Load() {
+					ip, ok = <-q
+				}
+				if !ok {
+					queues[i] = nil
+					open--
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case out <- scanJob{p, ip}:
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// output 把 p 的结果写到 OutputFile, 开启备份时同时备份, 返回写入的记录数
+// 分片时文件名会加上分片, 并保存分片信息, ctx 用于中断扫描后的跳数测试
+func (gs *GScanner) output(ctx context.Context, p *scanProfile) int {
+	records := p.Records()
+	cfg := p.config
+	outputFile := gs.shard.fileName(cfg.OutputFile)
+
+	var hops map[*ScanRecord]int
+	if gs.TraceAfterScan && p.mode != "trace" && len(records) > 0 {
+		log.Printf("%sStart tracing %d records", p.logPrefix(), len(records))
+		hops = gs.traceRecords(ctx, records)
+		if ctx.Err() != nil {
+			log.Printf("%sTracing interrupted, untraced records are written last", p.logPrefix())
+		}
+	}
+
+	if len(cfg.OutputFilter) > 0 {
+		filtered := records[:0:0]
+		for _, r := range records {
+			if r.Match(cfg.OutputFilter) {
+				filtered = append(filtered, r)
+			}
+		}
+		log.Printf("%s%d records matched the output filter %v", p.logPrefix(), len(filtered), cfg.OutputFilter)
+		records = filtered
+	}
+
+	// 没有找到时也保存, 合并时可以知道这个分片已经扫描了
+	if gs.shard.enabled() {
+		gs.writeShardMeta(p, outputFile, records)
+	}
+
+	if len(records) == 0 {
+		return 0
+	}
+
+	key, _ := sortKey(cfg.SortBy)
+	sort.SliceStable(records, func(i, j int) bool {
+		// 测试了跳数时跳数少的在前面, 测试失败的放到最后
+		if hi, hj := hops[records[i]], hops[records[j]]; hi != hj {
+			return hj == 0 || (hi != 0 && hi < hj)
+		}
+		if ki, kj := key(records[i]), key(records[j]); ki != kj {
+			return ki < kj
+		}
+		return records[i].RTT < records[j].RTT
+	})
+	a := make([]string, len(records))
+	for i, r := range records {
+		a[i] = r.IP
+	}
+	b := new(bytes.Buffer)
+	if cfg.OutputSeparator == "gop" {
+		out := strings.Join(a, `", "`)
+		b.WriteString(`"`)
+		b.WriteString(out)
+		b.WriteString(`",`)
+	} else {
+		out := strings.Join(a, cfg.OutputSeparator)
+		b.WriteString(out)
+	}
+
+	if err := os.WriteFile(outputFile, b.Bytes(), 0o644); err != nil {
+		log.Printf("Failed to write output file:%s for reason: %v", outputFile, err)
+	} else {
+		log.Printf("All results written to %s", outputFile)
+	}
+
+	if gs.EnableBackup {
+		filename := gs.shard.fileName(fmt.Sprintf("%s_%s_lv%d.txt", p.mode, time.Now().Format("20060102_150405"), cfg.Level))
+
+		bakfilename := filepath.Join(gs.BackupDir, filename)
+		if err := os.WriteFile(bakfilename, b.Bytes(), 0o644); err != nil {
+			log.Printf("Failed to write output file:%s for reason: %v\n", bakfilename, err)
+		} else {
+			log.Printf("All results written to %s\n", bakfilename)
+		}
+	}
+	return len(records)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+var gpkp, _ = base64.StdEncoding.DecodeString("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA9Yjf52KMHjf4N0KQf2yH0PtlgiX96MtrpP9t6Voj4pn2HOmSA5kTfAkKivpC1l5WJKp6M4Qf0elpu7l07FdMZmiTdzdVU/45EE23NLtfJXc3OxeU6jzlndW8w7RD6y6nR++wRBFj2LRBhd1BMEiTG7+39uBFAiHglkIXz9krZVY0ByYEDaj9fcou7+pIfDdNPwCfg9/vdYQueVdc/FduGpb//Iyappm+Jdl/liwG9xEqAoCA62MYPFBJh+WKyl8ZK1mWgQCg+1HbyncLC8mWT+9wScdcbSD9mbS04soud/0t3Au2axMMjBkrF5aYufCL9qAnu7bjjVGPva7Hm7GJnQIDAQAB")
+
+var errNoSuchBucket = "<?xml version='1.0' encoding='UTF-8'?><Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist.</Message></Error>"
+
+// ProviderProfile 是 CDN 服务商的验证参数, QUIC 和 TLS 等模式会使用它来确认是不是这个服务商的IP
+// 没有设置的项不会验证
+type ProviderProfile struct {
+	// 中间证书公钥的 sha256, base64 编码, 和 HPKP 的 pin-sha256 格式一样
+	SPKIPins []string
+	// 中间证书的 Organization
+	IssuerOrgs []string
+	// 没有设置 HTTPVerifyHosts 时使用的测试地址
+	VerifyHosts []string
+	// http 测试时响应头必须包含的内容, 比如 {"Server": "cloudflare"}
+	ExpectHeaders map[string]string
+	// QUIC 模式 http 测试时 Alt-Svc 必须包含的内容
+	AltSvc string
+	// 响应内容包含其中之一时认为失败, 只在 QUIC 等级 4 使用
+	BadBodies []string
+}
+
+// 内置的服务商, 可以在配置文件的 Providers 中覆盖或添加
+// cloudflare 和 akamai 的证书来自多个公共 CA, 不验证证书, 只能通过 http 测试的响应头确认
+var providers = map[string]*ProviderProfile{
+	"google": {
+		SPKIPins:    []string{spkiPin(gpkp)},
+		IssuerOrgs:  []string{"Google Trust Services LLC"},
+		VerifyHosts: []string{"dns.google.com"},
+		AltSvc:      `quic=":443"`,
+		BadBodies:   []string{errNoSuchBucket},
+	},
+	"cloudflare": {
+		VerifyHosts:   []string{"www.cloudflare.com"},
+		ExpectHeaders: map[string]string{"Server": "cloudflare"},
+		AltSvc:        `h3=":443"`,
+	},
+	// akamai 边缘服务器的 Server 为 AkamaiGHost, 存储服务为 AkamaiNetStorage
+	"akamai": {
+		VerifyHosts:   []string{"www.akamai.com"},
+		ExpectHeaders: map[string]string{"Server": "Akamai"},
+		AltSvc:        `h3=":443"`,
+	},
+}
+
+func spkiPin(spki []byte) string {
+	sum := sha256.Sum256(spki)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyCert 验证中间证书的 Organization 和公钥
+func (p *ProviderProfile) verifyCert(pcs []*x509.Certificate) bool {
+	if len(pcs) < 2 {
+		return false
+	}
+	if len(p.IssuerOrgs) > 0 {
+		org := pcs[1].Subject.Organization
+		if len(org) == 0 || !containsString(p.IssuerOrgs, org[0]) {
+			return false
+		}
+	}
+	if len(p.SPKIPins) > 0 {
+		for _, c := range pcs[1:] {
+			if containsString(p.SPKIPins, spkiPin(c.RawSubjectPublicKeyInfo)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (p *ProviderProfile) verifyHeader(h http.Header) bool {
+	for k, v := range p.ExpectHeaders {
+		if !strings.Contains(h.Get(k), v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *ProviderProfile) isBadBody(body []byte) bool {
+	for _, bad := range p.BadBodies {
+		if bytes.Contains(body, []byte(bad)) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyHost 随机返回一个测试地址, 没有设置 HTTPVerifyHosts 时使用服务商的
+func (sc *ScanConfig) verifyHost() string {
+	hosts := sc.HTTPVerifyHosts
+	if len(hosts) == 0 {
+		hosts = sc.provider.VerifyHosts
+	}
+	if len(hosts) == 0 {
+		return ""
+	}
+	return randomChoice(hosts)
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
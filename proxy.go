@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 代理扫描共用的部分
+
+// 未设置 ProxyTarget 时, 代理 CONNECT 的默认目标
+const defaultProxyTarget = "www.google.com:80"
+
+func proxyTarget(config *ScanConfig) string {
+	if config.ProxyTarget == "" {
+		return defaultProxyTarget
+	}
+	return config.ProxyTarget
+}
+
+// verifyTunnelHTTP 通过已经建立好的隧道访问目标, 只有返回 2xx/3xx 才算成功
+// 目标端口为 443 时会先进行 tls 握手
+func verifyTunnelHTTP(conn net.Conn, target string, deadline time.Time) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+
+	url := "http://" + target
+	if port == "443" {
+		conn = tls.Client(conn, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         host,
+		})
+		url = "https://" + host
+	}
+	conn.SetDeadline(deadline)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -1,12 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"io"
-	"math/rand"
-	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -15,8 +12,6 @@ import (
 	"github.com/quic-go/quic-go/http3"
 )
 
-var errNoSuchBucket = []byte("<?xml version='1.0' encoding='UTF-8'?><Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist.</Message></Error>")
-
 func testQuic(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
 	start := time.Now()
 
@@ -41,8 +36,8 @@ func testQuic(ctx context.Context, ip string, config *ScanConfig, record *ScanRe
 	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
 	defer cancel()
 
-	quicConn, err := quic.DialAddrEarly(ctx, net.JoinHostPort(ip, "443"), tlsCfg, quicCfg)
-	if err != nil {
+	quicConn, err := quic.DialAddrEarly(ctx, hostPort(ip, "443"), tlsCfg, quicCfg)
+	if noteNetError(err) != nil {
 		return false
 	}
 	defer quicConn.CloseWithError(0, "")
@@ -55,8 +50,7 @@ func testQuic(ctx context.Context, ip string, config *ScanConfig, record *ScanRe
 
 	// lv2 验证证书是否正确
 	if config.Level > 1 {
-		pkp := cs.PeerCertificates[1].RawSubjectPublicKeyInfo
-		if !bytes.Equal(gpkp, pkp) {
+		if !config.provider.verifyCert(cs.PeerCertificates) {
 			return false
 		}
 	}
@@ -76,19 +70,24 @@ func testQuic(ctx context.Context, ip string, config *ScanConfig, record *ScanRe
 			},
 			Timeout: config.ScanMaxRTT - time.Since(start),
 		}
-		url := "https://" + config.HTTPVerifyHosts[rand.Intn(len(config.HTTPVerifyHosts))]
+		url := "https://" + config.verifyHost()
 		req, _ := http.NewRequest(http.MethodGet, url, nil)
 		req.Close = true
 		resp, _ := hclient.Do(req)
-		if resp == nil || (resp.StatusCode < 200 || resp.StatusCode >= 400) || !strings.Contains(resp.Header.Get("Alt-Svc"), `quic=":443"`) {
+		if resp == nil || (resp.StatusCode < 200 || resp.StatusCode >= 400) {
 			return false
 		}
 		if resp.Body != nil {
 			defer resp.Body.Close()
-			// lv4 验证是否是 NoSuchBucket 错误
-			if config.Level > 3 && resp.Header.Get("Content-Type") == "application/xml; charset=UTF-8" { // 也许条件改为 || 更好
-				body, err := io.ReadAll(resp.Body)
-				if err != nil || bytes.Equal(body, errNoSuchBucket) {
+		}
+		if !strings.Contains(resp.Header.Get("Alt-Svc"), config.provider.AltSvc) || !config.provider.verifyHeader(resp.Header) {
+			return false
+		}
+		if resp.Body != nil {
+			// lv4 验证是否是错误页面, 比如 google 的 NoSuchBucket 错误
+			if config.Level > 3 && len(config.provider.BadBodies) > 0 {
+				body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+				if err != nil || config.provider.isBadBody(body) {
 					return false
 				}
 			} else {
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 无状态的 QUIC 版本协商探测, 参考 RFC 9000 6. Version Negotiation
+// 发送一个使用保留版本号的 Initial 大小的包, 服务器会回复支持的版本列表
+// 所有探测共用同一个 UDP socket, 不进行握手
+
+const (
+	// 保留的版本号, 格式为 0x?a?a?a?a, 服务器一定不支持
+	quicVNGreaseVersion = 0x1a2a3a4a
+	quicVNConnIDLen     = 8
+	// 客户端 Initial 包最小为 1200 字节
+	quicVNPacketSize = 1200
+)
+
+var errQuicVNSocket = errors.New("quicvn: could not open socket")
+
+var quicVersionNames = map[uint32]string{
+	0x00000001: "v1",
+	0x6b3343cf: "v2",
+	0xff00001d: "draft-29",
+	0xff00001c: "draft-28",
+	0xff00001b: "draft-27",
+	0x51303530: "Q050",
+	0x54303530: "T050",
+	0x54303531: "T051",
+}
+
+func quicVersionName(v uint32) string {
+	if name, ok := quicVersionNames[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08x", v)
+}
+
+func testQuicVN(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	addr, err := net.ResolveUDPAddr("udp", hostPort(ip, "443"))
+	if err != nil {
+		return false
+	}
+
+	// lv1 收到版本协商回复
+	versions, err := quicVN.probe(ctx, addr)
+	if err != nil || len(versions) == 0 {
+		return false
+	}
+	names := make([]string, len(versions))
+	supportV1 := false
+	for i, v := range versions {
+		names[i] = quicVersionName(v)
+		if v == 0x00000001 {
+			supportV1 = true
+		}
+	}
+	record.SetInfo("versions", strings.Join(names, ","))
+
+	// lv2 支持 QUIC v1
+	if config.Level > 1 && !supportV1 {
+		return false
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+var quicVN = &quicVNProber{pending: make(map[string]chan []byte)}
+
+// quicVNProber 共用 socket 发送探测包, 并把回复分发给对应的探测
+type quicVNProber struct {
+	once4, once6 sync.Once
+	conn4, conn6 *net.UDPConn
+	err4, err6   error
+
+	mu sync.Mutex
+	// key 为目标地址和发送时的 SCID, 也就是回复的 DCID
+	pending map[string]chan []byte
+}
+
+func (p *quicVNProber) conn(ip net.IP) (*net.UDPConn, error) {
+	if ip.To4() != nil {
+		p.once4.Do(func() { p.conn4, p.err4 = p.listen("udp4") })
+		return p.conn4, p.err4
+	}
+	p.once6.Do(func() { p.conn6, p.err6 = p.listen("udp6") })
+	return p.conn6, p.err6
+}
+
+// listen 打开共用的 socket, 每个地址族只打开一次, 失败时输出一次日志, 之后的探测都返回 errQuicVNSocket
+func (p *quicVNProber) listen(network string) (*net.UDPConn, error) {
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		log.Printf("QUICVN: could not open %s socket: %v\n", network, err)
+		return nil, err
+	}
+	go p.readLoop(c)
+	return c, nil
+}
+
+func (p *quicVNProber) probe(ctx context.Context, addr *net.UDPAddr) ([]uint32, error) {
+	conn, err := p.conn(addr.IP)
+	if err != nil {
+		return nil, errQuicVNSocket
+	}
+
+	b := make([]byte, quicVNPacketSize)
+	// Long Header, Fixed Bit 为 1, 其余位随机
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	b[0] |= 0xc0
+	binary.BigEndian.PutUint32(b[1:5], quicVNGreaseVersion)
+	b[5] = quicVNConnIDLen
+	dcid := b[6 : 6+quicVNConnIDLen]
+	b[6+quicVNConnIDLen] = quicVNConnIDLen
+	scid := b[7+quicVNConnIDLen : 7+2*quicVNConnIDLen]
+	key := addr.String() + "/" + string(scid)
+
+	ch := make(chan []byte, 1)
+	p.mu.Lock()
+	p.pending[key] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+	}()
+
+	if _, err := conn.WriteToUDP(b, addr); err != nil {
+		return nil, noteNetError(err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, noteNetError(ctx.Err())
+		case reply := <-ch:
+			// 回复的 SCID 必须是我们发送的 DCID
+			versions, rscid, ok := parseQuicVN(reply)
+			if ok && bytes.Equal(rscid, dcid) {
+				return versions, nil
+			}
+		}
+	}
+}
+
+func (p *quicVNProber) readLoop(conn *net.UDPConn) {
+	b := make([]byte, 1500)
+	for {
+		n, raddr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		// 先取出 DCID 找到对应的探测
+		if n < 7 || b[0]&0x80 == 0 || binary.BigEndian.Uint32(b[1:5]) != 0 {
+			continue
+		}
+		dcidLen := int(b[5])
+		if n < 6+dcidLen {
+			continue
+		}
+		key := raddr.String() + "/" + string(b[6:6+dcidLen])
+
+		p.mu.Lock()
+		ch, ok := p.pending[key]
+		p.mu.Unlock()
+		if ok {
+			select {
+			case ch <- bytes.Clone(b[:n]):
+			default:
+			}
+		}
+	}
+}
+
+// parseQuicVN 解析版本协商包, 返回支持的版本和 SCID
+func parseQuicVN(b []byte) (versions []uint32, scid []byte, ok bool) {
+	if len(b) < 7 || b[0]&0x80 == 0 || binary.BigEndian.Uint32(b[1:5]) != 0 {
+		return nil, nil, false
+	}
+	b = b[5:]
+	dcidLen := int(b[0])
+	if len(b) < 1+dcidLen+1 {
+		return nil, nil, false
+	}
+	b = b[1+dcidLen:]
+	scidLen := int(b[0])
+	if len(b) < 1+scidLen {
+		return nil, nil, false
+	}
+	scid = b[1 : 1+scidLen]
+	b = b[1+scidLen:]
+	if len(b) == 0 || len(b)%4 != 0 {
+		return nil, nil, false
+	}
+	for ; len(b) >= 4; b = b[4:] {
+		versions = append(versions, binary.BigEndian.Uint32(b))
+	}
+	return versions, scid, true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseQuicVN(t *testing.T) {
+	// 长包头, 版本为 0, DCID 2 字节, SCID 3 字节, 支持 v1 和 draft-29
+	vn := []byte{0x80, 0, 0, 0, 0, 2, 0xd1, 0xd2, 3, 0x51, 0x52, 0x53, 0, 0, 0, 1, 0xff, 0, 0, 29}
+	versions, scid, ok := parseQuicVN(vn)
+	if !ok {
+		t.Fatal("valid version negotiation packet rejected")
+	}
+	if len(versions) != 2 || versions[0] != 1 || versions[1] != 0xff00001d {
+		t.Errorf("got versions %x, want [1 ff00001d]", versions)
+	}
+	if !bytes.Equal(scid, []byte{0x51, 0x52, 0x53}) {
+		t.Errorf("got scid %x, want 515253", scid)
+	}
+
+	bad := map[string][]byte{
+		"short header":    append([]byte{0x40}, vn[1:]...),
+		"not version 0":   append([]byte{0x80, 0, 0, 0, 1}, vn[5:]...),
+		"truncated dcid":  vn[:7],
+		"truncated scid":  vn[:10],
+		"no versions":     vn[:12],
+		"partial version": vn[:14],
+	}
+	for name, b := range bad {
+		if _, _, ok := parseQuicVN(b); ok {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter 是所有扫描线程共用的令牌桶, 每秒产生 rate 个令牌, 最多存 burst 个
+// 用来限制每秒的新连接数或发包数, 不受 ScanWorker 的影响
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	// 下一个令牌可用的时间
+	next time.Time
+}
+
+// newRateLimiter 在 rate 小于等于 0 时返回 nil, 表示不限制
+func newRateLimiter(rate, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		interval: max(time.Second/time.Duration(rate), 1),
+		burst:    max(burst, 1),
+	}
+}
+
+// wait 等待一个令牌, ctx 结束时返回错误, 已经预留的令牌不会退回
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	// 空闲时令牌最多攒到 burst 个
+	if earliest := now.Add(-time.Duration(l.burst-1) * l.interval); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,9 +14,45 @@ import (
 type ScanRecord struct {
 	IP  string
 	RTT time.Duration
+	// 附加信息, 格式为 key=value, 比如 socks=socks4a
+	Info []string
+	// 多次测试的延迟统计, RTT 为成功的平均值
+	Stats RTTStats
+}
+
+// SetInfo 设置附加信息, 已经存在的 key 会被覆盖
+func (r *ScanRecord) SetInfo(key, value string) {
+	kv := key + "=" + value
+	for i, s := range r.Info {
+		if strings.HasPrefix(s, key+"=") {
+			r.Info[i] = kv
+			return
+		}
+	}
+	r.Info = append(r.Info, kv)
+}
+
+// Match 返回记录是否包含所有的 key=value
+// 如果只写了 key, 那么只要有这个 key 就算匹配
+func (r *ScanRecord) Match(filters []string) bool {
+	for _, f := range filters {
+		found := false
+		for _, s := range r.Info {
+			if s == f || (!strings.Contains(f, "=") && strings.HasPrefix(s, f+"=")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
 
 type ScanRecords struct {
+	// 同时扫描多个扫描方式时, 日志中显示的扫描方式
+	name        string
 	recordMutex sync.Mutex
 	records     []*ScanRecord
 	scanCounter int32
@@ -25,13 +62,24 @@ func (srs *ScanRecords) AddRecord(rec *ScanRecord) {
 	srs.recordMutex.Lock()
 	srs.records = append(srs.records, rec)
 	srs.recordMutex.Unlock()
-	log.Printf("Found a record: IP=%s, RTT=%s\n", rec.IP, rec.RTT.String())
+	if len(rec.Info) > 0 {
+		log.Printf("%sFound a record: IP=%s, RTT=%s, %s\n", srs.logPrefix(), rec.IP, rec.RTT.String(), strings.Join(rec.Info, ", "))
+	} else {
+		log.Printf("%sFound a record: IP=%s, RTT=%s\n", srs.logPrefix(), rec.IP, rec.RTT.String())
+	}
+}
+
+func (srs *ScanRecords) logPrefix() string {
+	if srs.name == "" {
+		return ""
+	}
+	return "[" + srs.name + "] "
 }
 
 func (srs *ScanRecords) IncScanCounter() {
 	scanCount := atomic.AddInt32(&srs.scanCounter, 1)
 	if scanCount%1000 == 0 {
-		log.Printf("Scanned %d IPs, Found %d records\n", scanCount, srs.RecordSize())
+		log.Printf("%sScanned %d IPs, Found %d records\n", srs.logPrefix(), scanCount, srs.RecordSize())
 	}
 }
 
@@ -55,54 +103,178 @@ type testIPFunc func(ctx context.Context, ip string, config *ScanConfig, record
 
 func testip(ctx context.Context, testFunc testIPFunc, ip string, config *ScanConfig) *ScanRecord {
 	record := new(ScanRecord)
+	// 失败超过这个次数就不用继续测试了, MaxLoss 为 0 时失败一次就放弃
+	maxLost := int(config.MaxLoss*float64(config.ScanCountPerIP) + 1e-9)
+	lost := 0
+	var samples []time.Duration
 	for i := 0; i < config.ScanCountPerIP; i++ {
-		if !testFunc(ctx, ip, config, record) {
+		// 每次测试的延迟为 RTT 的增加值, 失败的测试可能已经加了一部分, 需要还原
+		if config.limiter.wait(ctx) != nil {
 			return nil
 		}
+		rtt := record.RTT
+		if !testFunc(ctx, ip, config, record) {
+			record.RTT = rtt
+			if lost++; lost > maxLost {
+				return nil
+			}
+			continue
+		}
+		samples = append(samples, record.RTT-rtt)
+	}
+	if len(samples) == 0 {
+		return nil
 	}
 	record.IP = ip
-	record.RTT = record.RTT / time.Duration(config.ScanCountPerIP)
+	record.Stats, record.RTT = newRTTStats(samples, config.ScanCountPerIP)
+	if config.MaxJitter > 0 && record.Stats.StdDev > config.MaxJitter {
+		return nil
+	}
+	record.setStatsInfo(config.ScanCountPerIP)
 	return record
 }
 
-func (gs *GScanner) testIPWorker(ctx context.Context, ipQueue chan string) {
-	cfg, testFunc := gs.getScanConfig(gs.ScanMode)
-
-	for ip := range ipQueue {
-		// log.Printf("Start testing IP: %s", ip)
+func (gs *GScanner) testIPWorker(ctx context.Context, queue <-chan scanJob) {
+	for {
+		// 自适应并发时, 拿到名额才取下一个IP
+		if !gs.workers.acquire(ctx) {
+			return
+		}
+		job, ok := <-queue
+		if !ok {
+			gs.workers.release(false)
+			return
+		}
+		// 达到 RecordLimit 的不再扫描, 也不记为扫描完
+		if job.p.stopped.Load() {
+			gs.workers.release(false)
+			continue
+		}
+		subnet, ok := gs.subnets.acquire(ctx, job.ip)
+		if !ok {
+			gs.workers.release(false)
+			return
+		}
+		found, stop := gs.testIP(ctx, job.p, job.ip)
+		// 中断时扫描可能没有完成, 不记为扫描完, 这样 checkpoint 继续时会重新扫描
+		scanned := !stop
+		if scanned {
+			job.p.final.count(found)
+		}
+		gs.subnets.release(subnet)
+		gs.workers.release(scanned)
+		if stop {
+			return
+		}
+	}
+}
 
-		if gs.VerifyPing {
-			start := time.Now()
+// testIP 使用 p 的扫描方式扫描这个IP, 返回是否找到和是否被中断
+// 没有被中断时把IP标记为扫描完, 和添加记录在同一个 progress 锁内, 见 saveCheckpoint
+// 达到 RecordLimit 时 p 会停止, 其他扫描方式继续扫描
+func (gs *GScanner) testIP(ctx context.Context, p *scanProfile, ip string) (found, stop bool) {
+	// log.Printf("Start testing IP: %s", ip)
 
-			pingErr := Ping(ip, gs.ScanMaxPingRTT)
-			if pingErr != nil || time.Since(start) < gs.ScanMinPingRTT {
-				continue
-			}
+	select {
+	case <-ctx.Done():
+		return false, true
+	default:
+		r := testip(ctx, p.final.testFunc, ip, p.config)
+		if r == nil && ctx.Err() != nil {
+			// 被中断的不算扫描过
+			return false, true
 		}
-
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			r := testip(ctx, testFunc, ip, cfg)
-			if r != nil {
-				gs.AddRecord(r) // 这里放到前面，扫描时可能会多出一些记录, 但是不影响
-				if gs.RecordSize() >= cfg.RecordLimit {
-					return
-				}
+		p.progress.Lock()
+		defer p.progress.Unlock()
+		p.feeder.done(ip)
+		if r != nil {
+			p.AddRecord(r) // 这里放到前面，扫描时可能会多出一些记录, 但是不影响
+			if p.RecordSize() >= p.config.RecordLimit {
+				p.stopped.Store(true)
+				return true, false
 			}
-			gs.IncScanCounter() // 扫描完后才增加计数
 		}
-
+		p.IncScanCounter() // 扫描完后才增加计数
+		return r != nil, false
 	}
 }
 
-func (gs *GScanner) StartScan(ipQueue chan string) {
+func (gs *GScanner) StartScan() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	gs.subnets = newSubnetLimiter(gs.MaxPerSubnet, gs.SubnetPrefixV4, gs.SubnetPrefixV6)
+	context.AfterFunc(ctx, gs.subnets.wakeAll)
+
 	n := gs.ScanWorker
+	if gs.AdaptiveWorker {
+		// 从 ScanWorker 开始调整, 启动最大数量的线程, 超过当前并发的线程会等待
+		// 只调整 ScanMode 的线程, Pipeline 各阶段的线程数固定, 也占用文件数
+		fixed := 0
+		for _, s := range gs.stages {
+			fixed += s.workers
+		}
+		gs.workers = newWorkerController(gs.ScanWorker, or(gs.MaxScanWorker, gs.ScanWorker*4), fixed)
+		n = gs.workers.max
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go gs.workers.run(ctx)
+	}
+	if gs.CheckpointInterval > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			t := time.NewTicker(gs.CheckpointInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+					gs.saveCheckpoint()
+				}
+			}
+		}()
+	}
+
+	// 所有扫描方式共用扫描前的各个阶段和扫描线程
+	// 各扫描方式都扫描完或者达到 RecordLimit 后, 前面的阶段会依次结束
+	var stages sync.WaitGroup
+	stageCtx, stopStages := context.WithCancel(ctx)
+	queue := gs.startStages(stageCtx, gs.jobs(stageCtx), &stages)
+
 	ops(n, n, func(i, thread int) {
-		gs.testIPWorker(ctx, ipQueue)
+		gs.testIPWorker(ctx, queue)
 	})
+	// 最后一个阶段的输入已经关闭时, 前面的阶段都已经扫描完了
+	var finished bool
+	select {
+	case _, ok := <-queue:
+		finished = !ok
+	default:
+	}
+	stopStages()
+	stages.Wait()
+
+	if len(gs.stages) > 0 {
+		logFunnel(gs.stages, gs.profiles)
+	}
+
+	if gs.usesMode("sni") {
+		logSniFailures()
+	}
+
+	if gs.CheckpointInterval > 0 {
+		// 全部扫描完时不再需要 checkpoint, 中断或达到 RecordLimit 时保存
+		for _, p := range gs.profiles {
+			finished = finished && !p.stopped.Load()
+		}
+		if finished && ctx.Err() == nil {
+			os.Remove(gs.CheckpointFile)
+		} else {
+			gs.saveCheckpoint()
+			log.Printf("Checkpoint saved to %s, use -resume to continue\n", gs.CheckpointFile)
+		}
+	}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 分片扫描, 多台机器使用相同的IP段文件和 seed, 各自扫描其中一份, 不需要互相通信
+// 每个IP按 seed 和IP的 hash 分到一个分片, 各分片没有重复, 数量也基本相同
+
+// shard 表示把IP分为 Count 份, 只扫描第 Index 份, Index 从 1 开始
+type shard struct {
+	Index int
+	Count int
+}
+
+// parseShard 解析 i/n 格式的分片, 空字符串表示不分片
+func parseShard(s string) (shard, error) {
+	if s == "" {
+		return shard{}, nil
+	}
+	i, n, ok := strings.Cut(s, "/")
+	index, err1 := strconv.Atoi(i)
+	count, err2 := strconv.Atoi(n)
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 1 || index > count {
+		return shard{}, fmt.Errorf("invalid shard: %s, should be i/n and 1 <= i <= n", s)
+	}
+	return shard{Index: index, Count: count}, nil
+}
+
+func (s shard) enabled() bool {
+	return s.Count > 1
+}
+
+func (s shard) String() string {
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+// has 返回 ip 是否属于这个分片, 同一个IP的不同端口在同一个分片
+func (s shard) has(ip net.IP, seed int64) bool {
+	if !s.enabled() {
+		return true
+	}
+	var b [8 + net.IPv6len]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(seed))
+	copy(b[8:], ip.To16())
+	sum := sha256.Sum256(b[:])
+	return binary.BigEndian.Uint64(sum[:8])%uint64(s.Count) == uint64(s.Index-1)
+}
+
+// fileName 在文件名的扩展名前加上分片, 比如 out_quic_shard2of4.txt
+func (s shard) fileName(name string) string {
+	if !s.enabled() {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s_shard%dof%d%s", strings.TrimSuffix(name, ext), s.Index, s.Count, ext)
+}
+
+// shardMeta 和分片的结果一起保存, 合并各分片的结果时使用
+type shardMeta struct {
+	ScanMode  string
+	Level     int
+	Shard     string
+	Seed      int64
+	InputHash string
+	ScanCount int32
+	Time      string
+	Records   []*ScanRecord
+}
+
+// writeShardMeta 把分片信息和 records 写到输出文件旁边的 .meta.json 文件
+func (gs *GScanner) writeShardMeta(p *scanProfile, output string, records []*ScanRecord) {
+	meta := &shardMeta{
+		ScanMode:  p.mode,
+		Level:     p.config.Level,
+		Shard:     gs.shard.String(),
+		Seed:      p.feeder.seed,
+		InputHash: p.feeder.hash,
+		ScanCount: p.ScanCount(),
+		Time:      time.Now().Format(time.RFC3339),
+		Records:   records,
+	}
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		log.Printf("Failed to write shard meta: %v\n", err)
+		return
+	}
+	file := strings.TrimSuffix(output, filepath.Ext(output)) + ".meta.json"
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		log.Printf("Failed to write shard meta:%s for reason: %v\n", file, err)
+	} else {
+		log.Printf("Shard meta written to %s\n", file)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		in   string
+		want shard
+		ok   bool
+	}{
+		{"", shard{}, true},
+		{"1/1", shard{Index: 1, Count: 1}, true},
+		{"2/3", shard{Index: 2, Count: 3}, true},
+		{"3/3", shard{Index: 3, Count: 3}, true},
+		{"0/3", shard{}, false},
+		{"4/3", shard{}, false},
+		{"1/0", shard{}, false},
+		{"a/b", shard{}, false},
+		{"1", shard{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseShard(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseShard(%q) = %+v, %v, want %+v, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// 同一个 seed 的所有分片合起来正好是整个IP段, 每个IP只属于一个分片
+func TestFeederShardCoverage(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "iprange.txt")
+	if err := os.WriteFile(file, []byte("10.0.0.0/20\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const total = 1 << 12
+	for _, n := range []int{1, 3, 7} {
+		seen := make(map[string]int, total)
+		for i := 1; i <= n; i++ {
+			f, err := newIPFeeder(file, nil, 24, 48, 42, shard{Index: i, Count: n})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := drainFeeder(f)
+			if n > 1 && (len(got) == 0 || len(got) == total) {
+				t.Errorf("shard %d/%d: got %d IPs", i, n, len(got))
+			}
+			for _, addr := range got {
+				if j, ok := seen[addr]; ok {
+					t.Fatalf("shard %d/%d: %s is also in shard %d/%d", i, n, addr, j, n)
+				}
+				seen[addr] = i
+			}
+		}
+		if len(seen) != total {
+			t.Errorf("%d shards: got %d IPs, want %d", n, len(seen), total)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"net"
+	"crypto/x509"
+	"log"
 	"net/http"
 	"net/http/httputil"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +15,7 @@ func testSni(ctx context.Context, ip string, config *ScanConfig, record *ScanRec
 	tlscfg := &tls.Config{
 		InsecureSkipVerify: true,
 	}
+	config.applyTlsParams(tlscfg)
 
 	for _, serverName := range config.ServerName {
 		start := time.Now()
@@ -20,7 +23,7 @@ func testSni(ctx context.Context, ip string, config *ScanConfig, record *ScanRec
 		ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
 		defer cancel()
 
-		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(ip, "443"))
+		conn, err := dialContext(ctx, "tcp", hostPort(ip, "443"))
 		if err != nil {
 			return false
 		}
@@ -32,13 +35,37 @@ func testSni(ctx context.Context, ip string, config *ScanConfig, record *ScanRec
 			tlsconn.Close()
 			return false
 		}
+		recordTlsState(record, tlsconn.ConnectionState())
+		pcs := tlsconn.ConnectionState().PeerCertificates
+		// lv2 证书的 SAN 或通配符匹配 ServerName
 		if config.Level > 1 {
-			pcs := tlsconn.ConnectionState().PeerCertificates
-			if len(pcs) == 0 || pcs[0].Subject.CommonName != serverName {
+			if len(pcs) == 0 {
+				tlsconn.Close()
+				return false
+			}
+			if err := pcs[0].VerifyHostname(serverName); err != nil {
+				atomic.AddInt32(&sniFailures.hostname, 1)
+				tlsconn.Close()
+				return false
+			}
+		}
+		// lv4 使用系统或 CAFile 的根证书验证证书链
+		if config.Level > 3 {
+			opts := x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         config.tls.caPool,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range pcs[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			if _, err := pcs[0].Verify(opts); err != nil {
+				atomic.AddInt32(&sniFailures.chain, 1)
 				tlsconn.Close()
 				return false
 			}
 		}
+		// lv3 http 测试
 		if config.Level > 2 {
 			req, err := http.NewRequest(http.MethodHead, "https://"+serverName, nil)
 			if err != nil {
@@ -48,6 +75,7 @@ func testSni(ctx context.Context, ip string, config *ScanConfig, record *ScanRec
 			tlsconn.SetDeadline(time.Now().Add(config.ScanMaxRTT - time.Since(start)))
 			resp, err := httputil.NewClientConn(tlsconn, nil).Do(req)
 			if err != nil {
+				atomic.AddInt32(&sniFailures.http, 1)
 				tlsconn.Close()
 				return false
 			}
@@ -57,6 +85,7 @@ func testSni(ctx context.Context, ip string, config *ScanConfig, record *ScanRec
 			// 	resp.Body.Close()
 			// }
 			if resp.StatusCode >= 400 {
+				atomic.AddInt32(&sniFailures.http, 1)
 				tlsconn.Close()
 				return false
 			}
@@ -72,3 +101,21 @@ func testSni(ctx context.Context, ip string, config *ScanConfig, record *ScanRec
 	}
 	return true
 }
+
+// sniFailures 是证书或 http 验证失败的次数, 握手失败的不记录, 扫描结束时输出
+var sniFailures struct {
+	hostname int32
+	chain    int32
+	http     int32
+}
+
+// logSniFailures 输出各项验证失败的次数, 都没有失败时不输出
+func logSniFailures() {
+	hostErrs := atomic.LoadInt32(&sniFailures.hostname)
+	chainErrs := atomic.LoadInt32(&sniFailures.chain)
+	httpErrs := atomic.LoadInt32(&sniFailures.http)
+	if hostErrs+chainErrs+httpErrs == 0 {
+		return
+	}
+	log.Printf("SNI check failures: hostname=%d, chain=%d, http=%d\n", hostErrs, chainErrs, httpErrs)
+}
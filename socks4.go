@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS4 以及 SOCKS4A 协议
+// https://www.openssh.com/txt/socks4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
+
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+	socks4Granted    = 0x5a
+)
+
+var (
+	errSocks4Reply    = errors.New("socks4: bad reply")
+	errSocks4Rejected = errors.New("socks4: request rejected")
+	errSocks4Addr     = errors.New("socks4: bad address")
+)
+
+func testSocks4(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	target := proxyTarget(config)
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+
+	// 目标是域名时先尝试 SOCKS4A, 被拒绝的话再用本地解析的 IPv4 尝试 SOCKS4
+	variants := []string{"socks4"}
+	if ip := net.ParseIP(host); ip == nil {
+		variants = []string{"socks4a", "socks4"}
+	} else if ip.To4() == nil {
+		return false
+	}
+
+	// lv1 回复格式正确 (CONNECT 被拒绝也算)
+	// lv2 CONNECT 到目标成功
+	// lv3 通过隧道进行 http 访问
+	accepted := "rejected"
+	replied := false
+	for _, variant := range variants {
+		addr := target
+		if variant == "socks4" && net.ParseIP(host) == nil {
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+			if err != nil || len(ips) == 0 {
+				break
+			}
+			addr = net.JoinHostPort(ips[0].String(), port)
+		}
+
+		conn, err := dialContext(ctx, "tcp", hostPort(ip, "1080"))
+		if err != nil {
+			return false
+		}
+		conn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+
+		err = socks4Connect(conn, addr, config.ProxyUsername)
+		if err == errSocks4Rejected {
+			// 换下一种方式
+			conn.Close()
+			replied = true
+			continue
+		}
+		if err != nil {
+			// 回复格式不对, 说明不是 SOCKS4 代理
+			conn.Close()
+			return false
+		}
+
+		ok := config.Level < 3 || verifyTunnelHTTP(conn, target, start.Add(config.ScanMaxRTT))
+		conn.Close()
+		if !ok {
+			return false
+		}
+		accepted = variant
+		break
+	}
+
+	if accepted == "rejected" && (!replied || config.Level > 1) {
+		return false
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		record.SetInfo("socks", accepted)
+		return true
+	}
+	return false
+}
+
+// socks4Connect 发送 CONNECT 请求, addr 的 host 不是 IPv4 时使用 SOCKS4A
+func socks4Connect(rw io.ReadWriter, addr, userID string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return errSocks4Addr
+	}
+
+	b := []byte{socks4Version, socks4CmdConnect, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	if ip != nil {
+		b = append(b, ip...)
+	} else {
+		// SOCKS4A 使用 0.0.0.x 表示后面跟着域名
+		b = append(b, 0, 0, 0, 1)
+	}
+	b = append(b, userID...)
+	b = append(b, 0)
+	if ip == nil {
+		b = append(b, host...)
+		b = append(b, 0)
+	}
+	if _, err := rw.Write(b); err != nil {
+		return err
+	}
+
+	// VN CD DSTPORT DSTIP
+	if _, err := io.ReadFull(rw, b[:8]); err != nil {
+		return err
+	}
+	if b[0] != 0x00 || b[1] < socks4Granted || b[1] > 0x5d {
+		return errSocks4Reply
+	}
+	if b[1] != socks4Granted {
+		return errSocks4Rejected
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 协议, 参考 RFC 1928 和 RFC 1929
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+)
+
+var (
+	errSocks5Version  = errors.New("socks5: unexpected version")
+	errSocks5NoAuth   = errors.New("socks5: no acceptable auth method")
+	errSocks5AuthFail = errors.New("socks5: authentication failed")
+	errSocks5Connect  = errors.New("socks5: connect failed")
+	errSocks5Addr     = errors.New("socks5: bad address")
+)
+
+func testSocks5(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	conn, err := dialContext(ctx, "tcp", hostPort(ip, "1080"))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+
+	// lv1 协商成功 (如果设置了用户名, 还需要认证成功)
+	if err := socks5Handshake(conn, config.ProxyUsername, config.ProxyPassword); err != nil {
+		return false
+	}
+
+	// lv2 CONNECT 到目标成功
+	target := proxyTarget(config)
+	if config.Level > 1 {
+		if err := socks5Connect(conn, target); err != nil {
+			return false
+		}
+	}
+
+	// lv3 通过隧道进行 http 访问
+	if config.Level > 2 {
+		if !verifyTunnelHTTP(conn, target, start.Add(config.ScanMaxRTT)) {
+			return false
+		}
+	}
+
+	if rtt := time.Since(start); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+func socks5Handshake(rw io.ReadWriter, username, password string) error {
+	methods := []byte{socks5AuthNone}
+	if username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	b := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := rw.Write(b); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(rw, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return errSocks5Version
+	}
+
+	switch b[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if username == "" {
+			return errSocks5NoAuth
+		}
+		// RFC 1929
+		b = []byte{0x01, byte(len(username))}
+		b = append(b, username...)
+		b = append(b, byte(len(password)))
+		b = append(b, password...)
+		if _, err := rw.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, b[:2]); err != nil {
+			return err
+		}
+		if b[1] != 0x00 {
+			return errSocks5AuthFail
+		}
+		return nil
+	default:
+		return errSocks5NoAuth
+	}
+}
+
+func socks5Connect(rw io.ReadWriter, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return errSocks5Addr
+	}
+
+	b := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errSocks5Addr
+		}
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	if _, err := rw.Write(b); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP
+	if _, err := io.ReadFull(rw, b[:4]); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return errSocks5Version
+	}
+	if b[1] != 0x00 {
+		return errSocks5Connect
+	}
+
+	// 读掉 BND.ADDR 和 BND.PORT
+	var n int
+	switch b[3] {
+	case socks5AtypIPv4:
+		n = net.IPv4len
+	case socks5AtypIPv6:
+		n = net.IPv6len
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(rw, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return errSocks5Addr
+	}
+	_, err = io.ReadFull(rw, make([]byte, n+2))
+	return err
+}
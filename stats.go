@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RTTStats 是同一个IP多次测试 (ScanCountPerIP) 的延迟统计
+type RTTStats struct {
+	Min    time.Duration
+	Median time.Duration
+	Max    time.Duration
+	StdDev time.Duration
+	// 失败次数占测试次数的比例
+	Loss float64
+}
+
+// newRTTStats 根据成功的延迟和测试次数计算统计, 返回平均延迟
+func newRTTStats(samples []time.Duration, count int) (RTTStats, time.Duration) {
+	var st RTTStats
+	if count > 0 {
+		st.Loss = float64(count-len(samples)) / float64(count)
+	}
+	if len(samples) == 0 {
+		return st, 0
+	}
+
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	st.Min, st.Max = sorted[0], sorted[len(sorted)-1]
+	if n := len(sorted); n%2 == 1 {
+		st.Median = sorted[n/2]
+	} else {
+		st.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+	mean := sum / time.Duration(len(samples))
+	var variance float64
+	for _, d := range samples {
+		diff := float64(d - mean)
+		variance += diff * diff
+	}
+	st.StdDev = time.Duration(math.Sqrt(variance / float64(len(samples))))
+	return st, mean
+}
+
+// 可以用于 SortBy 的统计, rtt 是平均延迟
+var sortKeys = map[string]func(r *ScanRecord) float64{
+	"rtt":    func(r *ScanRecord) float64 { return float64(r.RTT) },
+	"min":    func(r *ScanRecord) float64 { return float64(r.Stats.Min) },
+	"median": func(r *ScanRecord) float64 { return float64(r.Stats.Median) },
+	"max":    func(r *ScanRecord) float64 { return float64(r.Stats.Max) },
+	"stddev": func(r *ScanRecord) float64 { return float64(r.Stats.StdDev) },
+	"loss":   func(r *ScanRecord) float64 { return r.Stats.Loss },
+}
+
+func sortKey(name string) (func(r *ScanRecord) float64, error) {
+	if name == "" {
+		name = "rtt"
+	}
+	if key, ok := sortKeys[name]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown sort key: %s", name)
+}
+
+// setStatsInfo 把统计添加到附加信息, 只测试一次时没有意义, 不添加
+func (r *ScanRecord) setStatsInfo(count int) {
+	if count < 2 {
+		return
+	}
+	r.SetInfo("min", r.Stats.Min.Round(time.Millisecond).String())
+	r.SetInfo("median", r.Stats.Median.Round(time.Millisecond).String())
+	r.SetInfo("max", r.Stats.Max.Round(time.Millisecond).String())
+	r.SetInfo("stddev", r.Stats.StdDev.Round(time.Millisecond).String())
+	r.SetInfo("loss", strconv.FormatFloat(r.Stats.Loss, 'f', 2, 64))
+}
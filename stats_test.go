@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// attempt 是一次测试的结果, 失败时 rtt 是失败前已经加到 RTT 上的部分
+type attempt struct {
+	rtt time.Duration
+	ok  bool
+}
+
+// scriptedTest 按顺序返回 attempts 的结果
+func scriptedTest(attempts []attempt) testIPFunc {
+	i := 0
+	return func(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+		a := attempts[i]
+		i++
+		record.RTT += a.rtt
+		return a.ok
+	}
+}
+
+func TestTestIPStats(t *testing.T) {
+	ms := time.Millisecond
+	ok := func(d time.Duration) attempt { return attempt{d * ms, true} }
+	fail := func(d time.Duration) attempt { return attempt{d * ms, false} }
+	tests := []struct {
+		name      string
+		attempts  []attempt
+		maxLoss   float64
+		maxJitter time.Duration
+		// nil 表示应该失败
+		want *RTTStats
+		rtt  time.Duration
+	}{
+		{"odd median", []attempt{ok(10), ok(30), ok(20)}, 0, 0,
+			&RTTStats{Min: 10 * ms, Median: 20 * ms, Max: 30 * ms, StdDev: 8164965}, 20 * ms},
+		{"even median", []attempt{ok(10), ok(40), ok(20), ok(30)}, 0, 0,
+			&RTTStats{Min: 10 * ms, Median: 25 * ms, Max: 40 * ms, StdDev: 11180339}, 25 * ms},
+		// 失败的测试已经加上的 500ms 不能算进结果
+		{"rollback failed attempt", []attempt{ok(10), fail(500), ok(30)}, 0.34, 0,
+			&RTTStats{Min: 10 * ms, Median: 20 * ms, Max: 30 * ms, StdDev: 10 * ms, Loss: 1.0 / 3}, 20 * ms},
+		{"no loss allowed", []attempt{ok(10), fail(5), ok(30)}, 0, 0, nil, 0},
+		{"loss at MaxLoss", []attempt{fail(0), ok(10), fail(0), ok(10)}, 0.5, 0,
+			&RTTStats{Min: 10 * ms, Median: 10 * ms, Max: 10 * ms, Loss: 0.5}, 10 * ms},
+		{"loss over MaxLoss", []attempt{fail(0), ok(10), fail(0), fail(0)}, 0.5, 0, nil, 0},
+		{"all lost", []attempt{fail(0), fail(0)}, 1, 0, nil, 0},
+		{"jitter under MaxJitter", []attempt{ok(10), ok(50)}, 0, 30 * ms,
+			&RTTStats{Min: 10 * ms, Median: 30 * ms, Max: 50 * ms, StdDev: 20 * ms}, 30 * ms},
+		{"jitter over MaxJitter", []attempt{ok(10), ok(50)}, 0, 10 * ms, nil, 0},
+	}
+	for _, tt := range tests {
+		config := &ScanConfig{ScanCountPerIP: len(tt.attempts), MaxLoss: tt.maxLoss, MaxJitter: tt.maxJitter}
+		r := testip(context.Background(), scriptedTest(tt.attempts), "10.0.0.1", config)
+		switch {
+		case tt.want == nil && r != nil:
+			t.Errorf("%s: got %+v, want failure", tt.name, r.Stats)
+		case tt.want == nil:
+		case r == nil:
+			t.Errorf("%s: failed, want %+v", tt.name, *tt.want)
+		case r.Stats != *tt.want || r.RTT != tt.rtt:
+			t.Errorf("%s: got %+v, RTT %s, want %+v, RTT %s", tt.name, r.Stats, r.RTT, *tt.want, tt.rtt)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// subnetLimiter 限制同一个子网同时扫描的IP数, 子网为 IPv4 /v4Bits, IPv6 /v6Bits
+type subnetLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	max      int
+	v4Bits   int
+	v6Bits   int
+	inflight map[string]int
+}
+
+// newSubnetLimiter 在 max 小于等于 0 时返回 nil, 表示不限制
+func newSubnetLimiter(max, v4Bits, v6Bits int) *subnetLimiter {
+	if max <= 0 {
+		return nil
+	}
+	l := &subnetLimiter{
+		max:      max,
+		v4Bits:   v4Bits,
+		v6Bits:   v6Bits,
+		inflight: make(map[string]int),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// subnetKey 返回 ip 所在的子网, ip 可以带有端口
+func subnetKey(ip string, v4Bits, v6Bits int) string {
+	addr := net.ParseIP(hostOnly(ip))
+	if addr == nil {
+		return ip
+	}
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(v4Bits, 32)).String() + "/" + strconv.Itoa(v4Bits)
+	}
+	return addr.Mask(net.CIDRMask(v6Bits, 128)).String() + "/" + strconv.Itoa(v6Bits)
+}
+
+// acquire 等待 ip 所在的子网有空位, 返回子网, ctx 结束时返回 false, l 为 nil 时不限制
+func (l *subnetLimiter) acquire(ctx context.Context, ip string) (string, bool) {
+	if l == nil {
+		return "", ctx.Err() == nil
+	}
+	key := subnetKey(ip, l.v4Bits, l.v6Bits)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inflight[key] >= l.max && ctx.Err() == nil {
+		l.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return "", false
+	}
+	l.inflight[key]++
+	return key, true
+}
+
+func (l *subnetLimiter) release(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.inflight[key]--; l.inflight[key] <= 0 {
+		delete(l.inflight, key)
+	}
+	l.mu.Unlock()
+	// 等待的可能是不同的子网, 需要全部唤醒
+	l.cond.Broadcast()
+}
+
+// wakeAll 在扫描结束时唤醒所有等待的线程
+func (l *subnetLimiter) wakeAll() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
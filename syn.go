@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TCP SYN 半开扫描, 使用 raw socket 发送 SYN, 收到 SYN-ACK 就认为端口开放, 不完成握手
+// 没有对应的 socket, 内核收到 SYN-ACK 后会自动回复 RST
+// 需要 root 或 CAP_NET_RAW 权限, Windows 不允许 raw socket 发送 TCP, 只能在 Linux 等系统上使用
+// 测试速率使用 SYN 设置的 ProbeRate 限制, 在测试开始前等待, 不占用 ScanMaxRTT
+
+var (
+	errSynSocket = errors.New("syn: could not open raw socket")
+	errSynClosed = errors.New("syn: port closed")
+)
+
+func testSyn(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	return testPorts(ctx, ip, config, record, "syn", func(ctx context.Context, ip string, port int) time.Duration {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return 0
+		}
+		rtt, err := synScan.probe(ctx, addr, port, 0)
+		if err != nil {
+			return 0
+		}
+		return rtt
+	})
+}
+
+var synScan = newSynProber()
+
+// synProber 共用 raw socket 发送 SYN, 并把回复分发给对应的探测
+// 序号使用无状态的 cookie (trace 时加上 TTL), 回复的确认号必须是序号+1
+type synProber struct {
+	once4, once6 sync.Once
+	conn4, conn6 *ttlConn
+	err4, err6   error
+
+	// 本地端口, 在 Linux 默认的临时端口范围之外, 避免和正常连接冲突
+	sport  uint16
+	secret [16]byte
+
+	mu sync.Mutex
+	// key 为目标地址、端口和 TTL
+	pending map[string]chan error
+}
+
+func newSynProber() *synProber {
+	p := &synProber{pending: make(map[string]chan error)}
+	rand.Read(p.secret[:])
+	var b [2]byte
+	rand.Read(b[:])
+	p.sport = 61000 + binary.BigEndian.Uint16(b[:])%4000
+	return p
+}
+
+func (p *synProber) conn(ip net.IP) (*ttlConn, error) {
+	if ip.To4() != nil {
+		p.once4.Do(func() { p.conn4, p.err4 = p.listen("ip4:tcp") })
+		return p.conn4, p.err4
+	}
+	p.once6.Do(func() { p.conn6, p.err6 = p.listen("ip6:tcp") })
+	return p.conn6, p.err6
+}
+
+// listen 打开 raw socket, 每个地址族只打开一次, 失败时输出一次日志, 之后的探测都返回 errSynSocket
+func (p *synProber) listen(network string) (*ttlConn, error) {
+	c, err := net.ListenIP(network, nil)
+	if err != nil {
+		log.Printf("SYN: could not open %s raw socket, root or CAP_NET_RAW is required: %v\n", network, err)
+		return nil, err
+	}
+	go p.readLoop(c)
+	return newTTLConn(c, network == "ip6:tcp"), nil
+}
+
+func (p *synProber) cookie(ip net.IP, port int) uint32 {
+	h := sha256.New()
+	h.Write(p.secret[:])
+	h.Write(ip.To16())
+	binary.Write(h, binary.BigEndian, uint16(port))
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+func synKey(ip net.IP, port, ttl int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)) + "/" + strconv.Itoa(ttl)
+}
+
+// seq 返回 SYN 的序号, trace 同时发送不同 TTL 的 SYN, 序号加上 TTL 区分回复
+func (p *synProber) seq(ip net.IP, port, ttl int) uint32 {
+	return p.cookie(ip, port) + uint32(ttl)
+}
+
+// probe 返回收到 SYN-ACK 的时间, 收到 RST 时返回 errSynClosed
+// ttl 为 0 时使用系统默认的 TTL
+func (p *synProber) probe(ctx context.Context, ip net.IP, port, ttl int) (time.Duration, error) {
+	conn, err := p.conn(ip)
+	if err != nil {
+		return 0, errSynSocket
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	// 通过路由找到发送使用的本地地址, 计算校验和需要
+	uc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		return 0, noteNetError(err)
+	}
+	src := uc.LocalAddr().(*net.UDPAddr).IP
+	uc.Close()
+	if src4 := src.To4(); src4 != nil {
+		src = src4
+	}
+
+	key := synKey(ip, port, ttl)
+	ch := make(chan error, 1)
+	p.mu.Lock()
+	p.pending[key] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+	}()
+
+	pkt := marshalSyn(src, ip, p.sport, uint16(port), p.seq(ip, port, ttl))
+	start := time.Now()
+	if err := conn.writeTo(pkt, &net.IPAddr{IP: ip}, ttl); err != nil {
+		return 0, noteNetError(err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return 0, noteNetError(ctx.Err())
+	case err := <-ch:
+		if err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+}
+
+// trace 发送 TTL 为 ttl 的 SYN, 到达目标时收到 SYN-ACK 或 RST, 返回目标的地址
+// 中间的路由器回复的 ICMP 超时由 icmpPinger 接收, 返回路由器的地址和 ErrPingTimeExceeded
+func (p *synProber) trace(ctx context.Context, ip net.IP, port, ttl int) (net.IP, error) {
+	if icmpPinger.conn(ip) == nil {
+		return nil, ErrPingConnFailed
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	icmpReply, cancel := icmpPinger.expect(tcpReplyKey(ip, int(p.sport), port, p.seq(ip, port, ttl)))
+	defer cancel()
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.probe(ctx, ip, port, ttl)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil && !errors.Is(err, errSynClosed) {
+			return nil, err
+		}
+		return ip, nil
+	case r := <-icmpReply:
+		return r.from, r.err
+	}
+}
+
+func (p *synProber) readLoop(conn *net.IPConn) {
+	b := make([]byte, 1500)
+	for {
+		// ip4 的 ReadFrom 会去掉 IP 头, 这里只有 TCP 头
+		n, raddr, err := conn.ReadFromIP(b)
+		if err != nil {
+			return
+		}
+		if n < 20 || binary.BigEndian.Uint16(b[2:4]) != p.sport {
+			continue
+		}
+		port := int(binary.BigEndian.Uint16(b[0:2]))
+		ack := binary.BigEndian.Uint32(b[8:12])
+		flags := b[13]
+		// 确认号减去 cookie+1 就是发送时的 TTL, 见 seq
+		ttl := ack - 1 - p.cookie(raddr.IP, port)
+		if ttl > 255 {
+			continue
+		}
+
+		var result error
+		switch {
+		case flags&0x12 == 0x12: // SYN-ACK
+		case flags&0x04 != 0: // RST
+			result = errSynClosed
+		default:
+			continue
+		}
+
+		ip := raddr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		p.mu.Lock()
+		ch, ok := p.pending[synKey(ip, port, int(ttl))]
+		p.mu.Unlock()
+		if ok {
+			select {
+			case ch <- result:
+			default:
+			}
+		}
+	}
+}
+
+// marshalSyn 构造带 MSS 选项的 SYN 包, 只有 TCP 头, IP 头由内核填充
+func marshalSyn(src, dst net.IP, sport, dport uint16, seq uint32) []byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint16(b[0:2], sport)
+	binary.BigEndian.PutUint16(b[2:4], dport)
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	b[12] = 6 << 4 // 头长度 24 字节
+	b[13] = 0x02   // SYN
+	binary.BigEndian.PutUint16(b[14:16], 65535)
+	// MSS 1460
+	b[20], b[21] = 2, 4
+	binary.BigEndian.PutUint16(b[22:24], 1460)
+	binary.BigEndian.PutUint16(b[16:18], tcpChecksum(src, dst, b))
+	return b
+}
+
+// tcpChecksum 计算包括伪首部的 TCP 校验和
+func tcpChecksum(src, dst net.IP, seg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src)
+	add(dst)
+	// IPv4 和 IPv6 的伪首部都是协议号和长度, 只是字段宽度不同, 求和结果相同
+	sum += 6 + uint32(len(seg))
+	add(seg)
+	for sum>>16 != 0 {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestTcpChecksum(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		want     uint16
+	}{
+		{"192.0.2.1", "198.51.100.2", 0x0df3},
+		{"2001:db8::1", "2001:db8::2", 0x9eb5},
+	}
+	for _, tt := range tests {
+		src, dst := net.ParseIP(tt.src), net.ParseIP(tt.dst)
+		if ip4 := src.To4(); ip4 != nil {
+			src, dst = ip4, dst.To4()
+		}
+		b := marshalSyn(src, dst, 40000, 443, 1)
+		if got := binary.BigEndian.Uint16(b[16:18]); got != tt.want {
+			t.Errorf("%s -> %s: got checksum %#04x, want %#04x", tt.src, tt.dst, got, tt.want)
+		}
+		// 包含校验和时再计算一次结果为 0
+		if got := tcpChecksum(src, dst, b); got != 0 {
+			t.Errorf("%s -> %s: checksum of the checksummed segment is %#04x, want 0", tt.src, tt.dst, got)
+		}
+	}
+}
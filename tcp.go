@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 未设置 TCPPorts 时, TCP 模式默认测试的端口
+// 设置了 Ports 时每个IP都带有端口, 只测试这个端口, TCPPorts 不起作用
+var defaultTCPPorts = []int{443}
+
+func testTcp(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	// 只测量连接时间, 连上就断开
+	return testPorts(ctx, ip, config, record, "tcp", func(ctx context.Context, ip string, port int) time.Duration {
+		start := time.Now()
+		conn, err := dialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err != nil {
+			return 0
+		}
+		rtt := time.Since(start)
+		conn.Close()
+		return rtt
+	})
+}
+
+// portProbeFunc 测试 ip 的一个端口, 返回端口开放时的 RTT, 没有开放时返回 0
+type portProbeFunc func(ctx context.Context, ip string, port int) time.Duration
+
+// testPorts 同时测试 TCPPorts 中的所有端口, TCP 和 SYN 模式共用
+// 开放端口的 RTT 记录为附加信息 name:端口, 结果的 RTT 为开放端口的平均值
+func testPorts(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord, name string, probe portProbeFunc) bool {
+	ports := config.TCPPorts
+	if len(ports) == 0 {
+		ports = defaultTCPPorts
+	}
+	// IP 带有端口时只测试这个端口
+	if host, port, err := net.SplitHostPort(ip); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return false
+		}
+		ip, ports = host, []int{p}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	rtts := make([]time.Duration, len(ports))
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i, port int) {
+			defer wg.Done()
+			rtts[i] = probe(ctx, ip, port)
+		}(i, port)
+	}
+	wg.Wait()
+
+	var open int
+	var total time.Duration
+	for i, rtt := range rtts {
+		if rtt == 0 {
+			continue
+		}
+		open++
+		total += rtt
+		record.SetInfo(name+":"+strconv.Itoa(ports[i]), rtt.Round(time.Millisecond).String())
+	}
+
+	// lv1 只要有一个端口开放
+	// lv2 所有端口都开放
+	if open == 0 || (config.Level > 1 && open < len(ports)) {
+		return false
+	}
+
+	// RTT 为开放端口的平均值
+	if rtt := total / time.Duration(open); rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLS 和 SNI 模式可以配置的 tls 参数, 都使用名字来设置
+
+var tlsVersions = map[string]uint16{
+	"TLS1.0": tls.VersionTLS10,
+	"TLS1.1": tls.VersionTLS11,
+	"TLS1.2": tls.VersionTLS12,
+	"TLS1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// tlsParams 是从 ScanConfig 中解析出来的 tls 参数
+type tlsParams struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+	// 为 nil 时使用系统的根证书
+	caPool *x509.CertPool
+}
+
+func parseTlsVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	// TLS1.2, TLS 1.2, 1.2 都可以
+	s := strings.ToUpper(strings.ReplaceAll(name, " ", ""))
+	if !strings.HasPrefix(s, "TLS") {
+		s = "TLS" + s
+	}
+	if v, ok := tlsVersions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown tls version: %s", name)
+}
+
+// parseTlsParams 解析 tls 参数, 在读取配置时调用
+func (sc *ScanConfig) parseTlsParams() error {
+	var err error
+	if sc.tls.minVersion, err = parseTlsVersion(sc.MinVersion); err != nil {
+		return err
+	}
+	if sc.tls.maxVersion, err = parseTlsVersion(sc.MaxVersion); err != nil {
+		return err
+	}
+
+	suites := make(map[string]*tls.CipherSuite)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[cs.Name] = cs
+	}
+	sc.tls.cipherSuites = nil
+	for _, name := range sc.CipherSuites {
+		cs, ok := suites[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		// crypto/tls 不能设置 TLS1.3 的加密套件, 设置了也会被忽略
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			return fmt.Errorf("TLS1.3 cipher suite can not be configured: %s", name)
+		}
+		sc.tls.cipherSuites = append(sc.tls.cipherSuites, cs.ID)
+	}
+
+	sc.tls.curves = nil
+	for _, name := range sc.CurvePreferences {
+		id, ok := tlsCurves[strings.TrimPrefix(strings.ToUpper(name), "CURVE")]
+		if !ok {
+			return fmt.Errorf("unknown curve: %s", name)
+		}
+		sc.tls.curves = append(sc.tls.curves, id)
+	}
+
+	sc.tls.caPool = nil
+	if sc.CAFile != "" {
+		data, err := os.ReadFile(sc.CAFile)
+		if err != nil {
+			return err
+		}
+		sc.tls.caPool = x509.NewCertPool()
+		if !sc.tls.caPool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", sc.CAFile)
+		}
+	}
+	return nil
+}
+
+// applyTlsParams 把配置的 tls 参数设置到 cfg
+// 返回是否设置了版本或加密套件, 没有设置时各模式使用自己的默认值
+func (sc *ScanConfig) applyTlsParams(cfg *tls.Config) bool {
+	cfg.CurvePreferences = sc.tls.curves
+	if len(sc.NextProtos) > 0 {
+		cfg.NextProtos = sc.NextProtos
+	}
+	if sc.tls.minVersion == 0 && sc.tls.maxVersion == 0 && len(sc.tls.cipherSuites) == 0 {
+		return false
+	}
+	cfg.MinVersion = sc.tls.minVersion
+	cfg.MaxVersion = sc.tls.maxVersion
+	cfg.CipherSuites = sc.tls.cipherSuites
+	return true
+}
+
+// recordTlsState 记录协商的版本、加密套件和 ALPN
+func recordTlsState(record *ScanRecord, cs tls.ConnectionState) {
+	record.SetInfo("tls", strings.ReplaceAll(tls.VersionName(cs.Version), " ", ""))
+	record.SetInfo("cipher", tls.CipherSuiteName(cs.CipherSuite))
+	if cs.NegotiatedProtocol != "" {
+		record.SetInfo("alpn", cs.NegotiatedProtocol)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// 使用 TTL 递增的探测包测试跳数, 和 traceroute 一样
+// 所有 TTL 同时发送, 第一个到达目标的 TTL 就是跳数
+// 中间的路由器回复 ICMP 超时, 可以得到最后几跳的地址, 用来发现走同一条线路的IP段
+// 探测包由 TraceProtocol 选择:
+// icmp 发送 echo 请求, 收到 echo 回复时到达目标, 没有 raw socket 权限时收不到超时, 只能得到跳数
+// tcp 发送 SYN (同 SYN 模式), 收到 SYN-ACK 或 RST 时到达目标, 适合过滤了 ICMP echo 的IP
+// udp 向 33434 开始的高端口发送, 收到端口不可达时到达目标
+// tcp 和 udp 需要 raw ICMP socket 接收超时和不可达
+
+const (
+	// 未设置 MaxHops 时最多测试的跳数
+	defaultMaxHops = 30
+	// 未设置 TraceLastHops 时记录的最后几跳
+	defaultTraceLastHops = 3
+
+	// udp 探测使用的目标端口, 和 traceroute 的默认端口一样从 33434 开始
+	traceUDPBasePort = 33434
+	traceUDPPorts    = 1024
+)
+
+// traceProbeFunc 发送一个 TTL 为 ttl 的探测包
+// 到达目标时返回目标的地址和 nil, 路由器回复超时时返回路由器的地址和 ErrPingTimeExceeded
+type traceProbeFunc func(ctx context.Context, ip net.IP, ttl int) (net.IP, error)
+
+// traceProbe 返回 TraceProtocol 对应的探测, tcp 探测 ip 的端口, 没有端口时使用 TCPPorts 的第一个
+func traceProbe(ip string, config *ScanConfig) traceProbeFunc {
+	switch config.TraceProtocol {
+	case "tcp":
+		port := 443
+		if len(config.TCPPorts) > 0 {
+			port = config.TCPPorts[0]
+		}
+		if _, p, err := net.SplitHostPort(ip); err == nil {
+			port, _ = strconv.Atoi(p)
+		}
+		return func(ctx context.Context, ip net.IP, ttl int) (net.IP, error) {
+			return synScan.trace(ctx, ip, port, ttl)
+		}
+	case "udp":
+		return udpTrace.probe
+	}
+	return func(ctx context.Context, ip net.IP, ttl int) (net.IP, error) {
+		r, err := icmpPinger.probe(ctx, ip, ttl)
+		return r.from, err
+	}
+}
+
+func testTrace(ctx context.Context, ip string, config *ScanConfig, record *ScanRecord) bool {
+	addr := net.ParseIP(hostOnly(ip))
+	if addr == nil {
+		return false
+	}
+	maxHops := or(config.MaxHops, defaultMaxHops)
+	probe := traceProbe(ip, config)
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanMaxRTT)
+	defer cancel()
+
+	type hop struct {
+		from    net.IP
+		rtt     time.Duration
+		reached bool
+	}
+	hops := make([]hop, maxHops+1)
+	var wg sync.WaitGroup
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		wg.Add(1)
+		go func(ttl int) {
+			defer wg.Done()
+			start := time.Now()
+			from, err := probe(ctx, addr, ttl)
+			switch {
+			case err == nil:
+				hops[ttl] = hop{from: from, rtt: time.Since(start), reached: true}
+			case errors.Is(err, ErrPingTimeExceeded):
+				hops[ttl] = hop{from: from}
+			}
+		}(ttl)
+	}
+	wg.Wait()
+
+	// lv1 在 MaxHops 跳内到达
+	count := 0
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if hops[ttl].reached {
+			count = ttl
+			break
+		}
+	}
+	if count == 0 {
+		return false
+	}
+	record.SetInfo("hops", strconv.Itoa(count))
+
+	// 最后几跳, 没有回复的记为 *
+	var last []string
+	for ttl := max(1, count-or(config.TraceLastHops, defaultTraceLastHops)); ttl < count; ttl++ {
+		if hops[ttl].from != nil {
+			last = append(last, hops[ttl].from.String())
+		} else {
+			last = append(last, "*")
+		}
+	}
+	if len(last) > 0 {
+		record.SetInfo("lasthops", strings.Join(last, ">"))
+	}
+
+	if rtt := hops[count].rtt; rtt > config.ScanMinRTT {
+		record.RTT += rtt
+		return true
+	}
+	return false
+}
+
+// traceRecords 扫描结束后测试找到的IP的跳数, 结果添加到记录的附加信息中
+// 测试失败和 ctx 结束后没有测试的记录跳数为 0, 中断后仍然会输出结果
+func (gs *GScanner) traceRecords(ctx context.Context, records []*ScanRecord) map[*ScanRecord]int {
+	var mu sync.Mutex
+	hops := make(map[*ScanRecord]int, len(records))
+	ops(len(records), min(gs.ScanWorker, len(records)), func(i, thread int) {
+		r := records[i]
+		if gs.Trace.limiter.wait(ctx) != nil {
+			return
+		}
+		tr := new(ScanRecord)
+		if !testTrace(ctx, r.IP, &gs.Trace, tr) {
+			return
+		}
+		count := 0
+		for _, info := range tr.Info {
+			k, v, _ := strings.Cut(info, "=")
+			r.SetInfo(k, v)
+			if k == "hops" {
+				count, _ = strconv.Atoi(v)
+			}
+		}
+		log.Printf("Trace: IP=%s, RTT=%s, %s\n", r.IP, tr.RTT, strings.Join(tr.Info, ", "))
+		mu.Lock()
+		hops[r] = count
+		mu.Unlock()
+	})
+	return hops
+}
+
+var udpTrace = new(udpTracer)
+
+// udpTracer 所有的 udp 探测共用一个 UDP socket (IPv4 和 IPv6 各一个)
+// 每个探测使用不同的目标端口, 超时和端口不可达由 icmpPinger 按端口分发
+type udpTracer struct {
+	once4, once6 sync.Once
+	conn4, conn6 *ttlConn
+	err4, err6   error
+
+	seq uint32
+}
+
+func (u *udpTracer) conn(ip net.IP) (*ttlConn, error) {
+	if ip.To4() != nil {
+		u.once4.Do(func() { u.conn4, u.err4 = listenTraceUDP("udp4") })
+		return u.conn4, u.err4
+	}
+	u.once6.Do(func() { u.conn6, u.err6 = listenTraceUDP("udp6") })
+	return u.conn6, u.err6
+}
+
+func listenTraceUDP(network string) (*ttlConn, error) {
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		log.Printf("Trace: could not open %s socket: %v\n", network, err)
+		return nil, err
+	}
+	return newTTLConn(c, network == "udp6"), nil
+}
+
+// probe 发送 TTL 为 ttl 的 UDP 包, 目标回复端口不可达时到达目标
+func (u *udpTracer) probe(ctx context.Context, ip net.IP, ttl int) (net.IP, error) {
+	if icmpPinger.conn(ip) == nil {
+		return nil, ErrPingConnFailed
+	}
+	tc, err := u.conn(ip)
+	if err != nil {
+		return nil, ErrPingConnFailed
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	sport := tc.c.LocalAddr().(*net.UDPAddr).Port
+	dport := traceUDPBasePort + int(atomic.AddUint32(&u.seq, 1)%traceUDPPorts)
+	reply, cancel := icmpPinger.expect(udpReplyKey(ip, sport, dport))
+	defer cancel()
+
+	if err := tc.writeTo(make([]byte, 32), &net.UDPAddr{IP: ip, Port: dport}, ttl); err != nil {
+		return nil, noteNetError(err)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-reply:
+		if errors.Is(r.err, ErrPingPortUnreachable) {
+			return r.from, nil
+		}
+		return r.from, r.err
+	}
+}
+
+// ttlConn 是可以给每个包设置 TTL (IPv6 为 Hop Limit) 的共用 socket
+// 发送时临时修改 socket 的 TTL, 发送后恢复, 所以同一个 socket 的发送需要加锁
+type ttlConn struct {
+	mu sync.Mutex
+	c  net.PacketConn
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+}
+
+// newTTLConn 包装 raw IP 或 UDP socket
+func newTTLConn(c net.PacketConn, v6 bool) *ttlConn {
+	tc := &ttlConn{c: c}
+	if v6 {
+		tc.p6 = ipv6.NewPacketConn(c)
+	} else {
+		tc.p4 = ipv4.NewPacketConn(c)
+	}
+	return tc
+}
+
+// writeTo 发送 b, ttl 为 0 时使用 socket 的 TTL
+func (tc *ttlConn) writeTo(b []byte, dst net.Addr, ttl int) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if ttl > 0 {
+		old, err := tc.ttl()
+		if err != nil {
+			return err
+		}
+		if err := tc.setTTL(ttl); err != nil {
+			return err
+		}
+		defer tc.setTTL(old)
+	}
+	_, err := tc.c.WriteTo(b, dst)
+	return err
+}
+
+func (tc *ttlConn) ttl() (int, error) {
+	if tc.p6 != nil {
+		return tc.p6.HopLimit()
+	}
+	return tc.p4.TTL()
+}
+
+func (tc *ttlConn) setTTL(ttl int) error {
+	if tc.p6 != nil {
+		return tc.p6.SetHopLimit(ttl)
+	}
+	return tc.p4.SetTTL(ttl)
+}
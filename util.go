@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"os"
 	"path"
 	"strings"
@@ -133,6 +134,22 @@ func or[T comparable](vals ...T) T {
 	return zero
 }
 
+// hostPort 返回要连接的地址, ip 带有端口时使用它的端口, 否则使用默认端口
+func hostPort(ip, port string) string {
+	if _, _, err := net.SplitHostPort(ip); err == nil {
+		return ip
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// hostOnly 去掉 ip 的端口
+func hostOnly(ip string) string {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
 // pathExist 返回文件或文件夹是否存在
 func pathExist(name string) bool {
 	_, err := os.Stat(name)